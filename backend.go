@@ -2,6 +2,8 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"sync"
 
@@ -12,6 +14,9 @@ import (
 // Factory returns a new backend as logical.Backend
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
 	b := backend()
+	if err := b.configureWALRollback(conf.Config); err != nil {
+		return nil, err
+	}
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
 	}
@@ -23,15 +28,32 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 // target API's client.
 type thingsDBBackend struct {
 	*framework.Backend
-	lock   sync.RWMutex
-	client *thingsDBClient
+	lock      sync.RWMutex
+	client    *thingsDBClient
+	newClient func(config *thingsDBConfig) (*thingsDBClient, error)
+
+	// rootLock serializes rotations of the root token
+	// and changes to the config
+	rootLock sync.Mutex
+
+	// staticLock serializes changes to static roles and their tokens
+	staticLock sync.Mutex
+
+	// indexLock serializes changes to the credentials index
+	indexLock sync.Mutex
 }
 
+// maxClientRetries is the number of times an operation is
+// retried on a new connection after the connection was lost.
+const maxClientRetries = 2
+
 // backend defined the target API backend
 // for Vault. It must include each path
 // and the secrets it will store.
 func backend() *thingsDBBackend {
-	b := thingsDBBackend{}
+	b := thingsDBBackend{
+		newClient: newClient,
+	}
 
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
@@ -40,20 +62,30 @@ func backend() *thingsDBBackend {
 			SealWrapStorage: []string{
 				"config",
 				"role/*",
+				"static-role/*",
 			},
 		},
 		Paths: framework.PathAppend(
 			pathRole(&b),
+			pathStaticRole(&b),
+			pathTidy(&b),
+			pathCredsIndex(&b),
 			[]*framework.Path{
 				pathConfig(&b),
 				pathCredentials(&b),
+				pathStaticCredentials(&b),
+				pathRotateRoot(&b),
+				pathRotateRole(&b),
 			},
 		),
 		Secrets: []*framework.Secret{
 			b.thingsDBToken(),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:       logical.TypeLogical,
+		Invalidate:        b.invalidate,
+		PeriodicFunc:      b.periodicFunc,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 	return &b
 }
@@ -63,9 +95,49 @@ func backend() *thingsDBBackend {
 func (b *thingsDBBackend) reset() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if b.client != nil {
+		b.client.Close()
+	}
 	b.client = nil
 }
 
+// periodicFunc runs the scheduled tasks of the backend,
+// such as the automatic rotation of the root token.
+func (b *thingsDBBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if !b.WriteSafeReplicationState() {
+		return nil
+	}
+
+	// The tasks are independent, so a failing task never holds up the others
+	var errs []error
+	if err := b.rotateRootIfDue(ctx, req.Storage); err != nil {
+		b.Logger().Error("error rotating root token", "error", err)
+		errs = append(errs, fmt.Errorf("error rotating root token: %w", err))
+	}
+
+	if err := b.rotateStaticRolesIfDue(ctx, req.Storage); err != nil {
+		errs = append(errs, fmt.Errorf("error rotating static roles: %w", err))
+	}
+
+	if err := b.autoTidyIfDue(ctx, req.Storage); err != nil {
+		b.Logger().Error("error tidying users", "error", err)
+		errs = append(errs, fmt.Errorf("error tidying users: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// discardClient closes a client whose connection was lost and
+// removes it from the backend, if it is still the active client.
+func (b *thingsDBBackend) discardClient(client *thingsDBClient) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.client == client {
+		b.client = nil
+	}
+	client.Close()
+}
+
 // invalidate clears an existing client configuration in
 // the backend
 func (b *thingsDBBackend) invalidate(ctx context.Context, key string) {
@@ -81,7 +153,7 @@ func (b *thingsDBBackend) getClient(ctx context.Context, s logical.Storage) (*th
 	unlockFunc := b.lock.RUnlock
 	defer func() { unlockFunc() }()
 
-	if b.client != nil {
+	if b.client != nil && b.client.IsConnected() {
 		return b.client, nil
 	}
 
@@ -89,6 +161,14 @@ func (b *thingsDBBackend) getClient(ctx context.Context, s logical.Storage) (*th
 	b.lock.Lock()
 	unlockFunc = b.lock.Unlock
 
+	if b.client != nil {
+		if b.client.IsConnected() {
+			return b.client, nil
+		}
+		b.client.Close()
+		b.client = nil
+	}
+
 	config, err := getConfig(ctx, s)
 	if err != nil {
 		return nil, err
@@ -98,7 +178,7 @@ func (b *thingsDBBackend) getClient(ctx context.Context, s logical.Storage) (*th
 		config = new(thingsDBConfig)
 	}
 
-	b.client, err = newClient(config)
+	b.client, err = b.newClient(config)
 	if err != nil {
 		return nil, err
 	}
@@ -106,6 +186,35 @@ func (b *thingsDBBackend) getClient(ctx context.Context, s logical.Storage) (*th
 	return b.client, nil
 }
 
+// withClient calls fn with the backend client. When the connection
+// turns out to be lost, the client is discarded and fn is retried
+// on a new connection a bounded number of times.
+func (b *thingsDBBackend) withClient(ctx context.Context, s logical.Storage, fn func(*thingsDBClient) error) error {
+	var err error
+	for attempt := 0; attempt <= maxClientRetries; attempt++ {
+		if attempt > 0 {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+		}
+
+		var client *thingsDBClient
+		client, err = b.getClient(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		err = fn(client)
+		if err == nil || !client.isConnectionError(err) {
+			return err
+		}
+
+		b.Logger().Warn("lost connection to ThingsDB, reconnecting", "attempt", attempt+1, "error", err)
+		b.discardClient(client)
+	}
+	return err
+}
+
 // backendHelp should contain help information about the backend
 const backendHelp = `
 The ThingsDB secrets backend dynamically generates API tokens for ThingsDB.
@@ -2,8 +2,12 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"errors"
+	"net"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -125,4 +129,185 @@ func (e *testEnv) CleanupUserTokens(t *testing.T) {
 	if len(e.Tokens) == 0 {
 		t.Fatalf("expected 2 tokens, got: %d", len(e.Tokens))
 	}
-}
\ No newline at end of file
+}
+
+// fakeConn is an in-memory stand-in for the ThingsDB connector.
+type fakeConn struct {
+	mu        sync.Mutex
+	connected bool
+	queries   []string
+	vars      []map[string]interface{}
+
+	// QueryFunc handles the queries, returning nil when not set
+	QueryFunc func(scope string, code string, vars map[string]interface{}) (interface{}, error)
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{connected: true}
+}
+
+func (c *fakeConn) Query(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+	c.mu.Lock()
+	c.queries = append(c.queries, code)
+	c.vars = append(c.vars, vars)
+	queryFunc := c.QueryFunc
+	c.mu.Unlock()
+
+	if queryFunc == nil {
+		return nil, nil
+	}
+	return queryFunc(scope, code, vars)
+}
+
+func (c *fakeConn) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+// Queries returns the code of all queries received so far.
+func (c *fakeConn) Queries() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+// Vars returns the variables of all queries received so far.
+func (c *fakeConn) Vars() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]map[string]interface{}(nil), c.vars...)
+}
+
+// useFakeConns makes the backend hand out the given fake
+// connections, one for each new client.
+func useFakeConns(b *thingsDBBackend, conns ...*fakeConn) {
+	var mu sync.Mutex
+	b.newClient = func(config *thingsDBConfig) (*thingsDBClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(conns) == 0 {
+			return nil, errors.New("no fake connection left")
+		}
+		conn := conns[0]
+		conns = conns[1:]
+		return &thingsDBClient{conn}, nil
+	}
+}
+
+// TestClientReconnect checks that a lost connection is
+// replaced and the in-flight operation is retried.
+func TestClientReconnect(t *testing.T) {
+	t.Run("reconnect on lost connection", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		dead := newFakeConn()
+		dead.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			dead.Close()
+			return nil, errors.New("not connected")
+		}
+		alive := newFakeConn()
+		useFakeConns(b, dead, alive)
+
+		err := b.withClient(context.Background(), s, func(c *thingsDBClient) error {
+			_, err := c.Query("@thingsdb", "nil;", nil)
+			return err
+		})
+		require.NoError(t, err)
+		require.Len(t, dead.Queries(), 1)
+		require.Len(t, alive.Queries(), 1)
+
+		client, err := b.getClient(context.Background(), s)
+		require.NoError(t, err)
+		require.Same(t, alive, client.thingsDBConn)
+	})
+
+	t.Run("bounded retries", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		var conns []*fakeConn
+		for i := 0; i <= maxClientRetries+1; i++ {
+			conn := newFakeConn()
+			conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+				conn.Close()
+				return nil, errors.New("not connected")
+			}
+			conns = append(conns, conn)
+		}
+		useFakeConns(b, conns...)
+
+		err := b.withClient(context.Background(), s, func(c *thingsDBClient) error {
+			_, err := c.Query("@thingsdb", "nil;", nil)
+			return err
+		})
+		require.Error(t, err)
+		require.Empty(t, conns[maxClientRetries+1].Queries())
+	})
+
+	t.Run("reconnect when a request times out", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		// A node which accepts the connection, but never answers
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		hung, err := dialNode(thingsDBNode{host: "127.0.0.1", port: uint16(addr.Port)}, nil, 100*time.Millisecond)
+		require.NoError(t, err)
+		defer hung.Close()
+
+		alive := newFakeConn()
+		var clients []*thingsDBClient
+		b.newClient = func(config *thingsDBConfig) (*thingsDBClient, error) {
+			client := &thingsDBClient{alive}
+			if len(clients) == 0 {
+				client = &thingsDBClient{hung}
+			}
+			clients = append(clients, client)
+			return client, nil
+		}
+
+		err = b.withClient(context.Background(), s, func(c *thingsDBClient) error {
+			_, err := c.Query("@thingsdb", "nil;", nil)
+			return err
+		})
+		require.NoError(t, err)
+		require.Len(t, clients, 2)
+		require.Len(t, alive.Queries(), 1)
+		require.Eventually(t, func() bool { return !hung.IsConnected() }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("no retry on query errors", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("lookup error")
+		}
+		useFakeConns(b, conn)
+
+		err := b.withClient(context.Background(), s, func(c *thingsDBClient) error {
+			_, err := c.Query("@thingsdb", "nil;", nil)
+			return err
+		})
+		require.EqualError(t, err, "lookup error")
+		require.Len(t, conn.Queries(), 1)
+		require.True(t, conn.IsConnected())
+	})
+}
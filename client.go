@@ -1,16 +1,40 @@
 package vault_plugin_secrets_thingsdb
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	ti "github.com/thingsdb/go-thingsdb"
 )
 
+// clientRequestTimeout bounds how long a single request to ThingsDB
+// may take. The connector then reports the connection as lost, after
+// which the backend discards it and retries on a new connection.
+const clientRequestTimeout = 30 * time.Second
+
+// errNotConnected is the message of the error the connector returns
+// when it is not connected, or when a request timed out or failed on
+// the node. Without auto reconnect, the connector never retries these.
+const errNotConnected = "not connected"
+
+// thingsDBConn is the part of the ThingsDB connector used by
+// the backend, which allows replacing it in tests.
+type thingsDBConn interface {
+	Query(scope string, code string, vars map[string]interface{}) (interface{}, error)
+	IsConnected() bool
+	Close()
+}
+
 // thingsDBClient creates an object storing
 // the ThingsDB Conn
 type thingsDBClient struct {
-	*ti.Conn
+	thingsDBConn
 }
 
 // newClient creates a new client to access ThingsDB
@@ -20,29 +44,196 @@ func newClient(config *thingsDBConfig) (*thingsDBClient, error) {
 		return nil, errors.New("client config is nil")
 	}
 
-	if config.Hostname == "" {
-		return nil, errors.New("client hostname was not defined")
+	nodes, err := config.nodes()
+	if err != nil {
+		return nil, err
 	}
 
-	if config.Token == "" {
-		return nil, errors.New("client token was not defined")
+	if config.Token == "" && (config.Username == "" || config.Password == "") {
+		return nil, errors.New("client token or username and password were not defined")
 	}
 
-	if config.Port == "" {
-		return nil, errors.New("client port not provided")
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
-	parsedPort, err := strconv.ParseUint(config.Port, 10, 16)
+	// Connect to the first reachable node. The backend reconnects by
+	// discarding a dead client and creating a new one, which fails over
+	// to the next node when a node is down.
+	var conn *ti.Conn
+	for _, node := range nodes {
+		conn, err = dialNode(node, tlsConfig, clientRequestTimeout)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	conn := ti.NewConn(config.Hostname, uint16(parsedPort), nil)
-	if err := conn.Connect(); err != nil {
-		return nil, err
+	if config.Token != "" {
+		err = conn.AuthToken(config.Token)
+	} else {
+		err = conn.AuthPassword(config.Username, config.Password)
 	}
-	if err := conn.AuthToken(config.Token); err != nil {
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+
 	return &thingsDBClient{conn}, nil
 }
+
+// dialNode connects to a single ThingsDB node. Auto reconnect is
+// disabled before connecting, as the connector's goroutines read it:
+// with auto reconnect enabled the connector would block in-flight
+// requests until the connection comes back.
+func dialNode(node thingsDBNode, tlsConfig *tls.Config, timeout time.Duration) (*ti.Conn, error) {
+	conn := ti.NewConn(node.host, node.port, tlsConfig)
+	conn.AutoReconnect = false
+	conn.DefaultTimeout = timeout
+
+	if err := conn.Connect(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isConnectionError reports whether err means the connection
+// to ThingsDB is lost and the request should be retried on a
+// new connection.
+func (c *thingsDBClient) isConnectionError(err error) bool {
+	if !c.IsConnected() {
+		return true
+	}
+
+	var tiErr *ti.TiError
+	if errors.As(err, &tiErr) {
+		switch tiErr.Code() {
+		case ti.RequestCancelError, ti.RequestTimeoutError, ti.NodeError, ti.WriteUVError:
+			return true
+		}
+		return false
+	}
+
+	// A request which timed out leaves the connection open, but a
+	// socket which stopped answering is just as dead
+	if err.Error() == errNotConnected {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// thingsDBNode is the address of a single ThingsDB node.
+type thingsDBNode struct {
+	host string
+	port uint16
+}
+
+// nodes returns the ThingsDB nodes to connect to. When a list
+// of nodes is configured it takes precedence over the single
+// hostname and port shorthand.
+func (c *thingsDBConfig) nodes() ([]thingsDBNode, error) {
+	if len(c.Nodes) == 0 {
+		if c.Hostname == "" {
+			return nil, errors.New("client hostname was not defined")
+		}
+
+		if c.Port == "" {
+			return nil, errors.New("client port not provided")
+		}
+
+		port, err := strconv.ParseUint(c.Port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		return []thingsDBNode{{host: c.Hostname, port: uint16(port)}}, nil
+	}
+
+	nodes := make([]thingsDBNode, 0, len(c.Nodes))
+	for _, address := range c.Nodes {
+		host, portRaw, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q: %w", address, err)
+		}
+
+		if host == "" {
+			return nil, fmt.Errorf("invalid node %q: missing host", address)
+		}
+
+		port, err := strconv.ParseUint(portRaw, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q: %w", address, err)
+		}
+
+		nodes = append(nodes, thingsDBNode{host: host, port: uint16(port)})
+	}
+
+	return nodes, nil
+}
+
+// newTLSConfig builds the TLS configuration for the ThingsDB
+// connection. A nil config is returned when TLS is disabled,
+// which makes the connection fall back to plain TCP.
+func newTLSConfig(config *thingsDBConfig) (*tls.Config, error) {
+	if !config.TLSEnabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, errors.New("could not parse any certificates from ca_cert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// privilegeProbeQuery returns the privileges the authenticated
+// user has on the @thingsdb scope, without changing anything.
+const privilegeProbeQuery = `
+access = user_info().load().access.find(|a| a.scope == '@thingsdb');
+is_nil(access) ? '' : access.privileges;
+`
+
+// verifyPrivileges checks that the authenticated user is allowed to
+// manage users and tokens, which requires GRANT on @thingsdb.
+func (c *thingsDBClient) verifyPrivileges() error {
+	resp, err := c.Query("@thingsdb", privilegeProbeQuery, nil)
+	if err != nil {
+		return fmt.Errorf("error reading privileges: %w", err)
+	}
+
+	privileges, ok := resp.(string)
+	if !ok {
+		return fmt.Errorf("unexpected privileges response: %v", resp)
+	}
+
+	for _, privilege := range strings.Split(privileges, "|") {
+		if privilege == "GRANT" || privilege == "FULL" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user lacks GRANT privileges on @thingsdb (has %q), which are required for new_user, grant, new_token and del_user", privileges)
+}
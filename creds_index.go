@@ -0,0 +1,131 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const credsIndexStoragePrefix = "creds-index/"
+
+// thingsDBCredsIndexEntry tracks a user created for dynamic
+// credentials, until the leases of the credentials are revoked.
+// A user shared by roles which only delete the token on revocation
+// can have multiple active tokens.
+type thingsDBCredsIndexEntry struct {
+	User       string    `json:"user"`
+	Role       string    `json:"role"`
+	TokenIDs   []string  `json:"token_ids"`
+	CreatedAt  time.Time `json:"created_at"`
+	Expiration time.Time `json:"expiration"`
+
+	// Metadata of the requester of the credentials
+	DisplayName string `json:"display_name"`
+	EntityID    string `json:"entity_id"`
+}
+
+// toResponseData returns response data for a tracked user
+func (e *thingsDBCredsIndexEntry) toResponseData() map[string]interface{} {
+	expiration := ""
+	if !e.Expiration.IsZero() {
+		expiration = e.Expiration.Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"user":         e.User,
+		"role":         e.Role,
+		"token_ids":    e.TokenIDs,
+		"created_at":   e.CreatedAt.Format(time.RFC3339),
+		"expiration":   expiration,
+		"display_name": e.DisplayName,
+		"entity_id":    e.EntityID,
+	}
+}
+
+func getCredsIndex(ctx context.Context, s logical.Storage, user string) (*thingsDBCredsIndexEntry, error) {
+	entry, err := s.Get(ctx, credsIndexStoragePrefix+user)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var index thingsDBCredsIndexEntry
+
+	if err = entry.DecodeJSON(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func setCredsIndex(ctx context.Context, s logical.Storage, index *thingsDBCredsIndexEntry) error {
+	entry, err := logical.StorageEntryJSON(credsIndexStoragePrefix+index.User, index)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return fmt.Errorf("failed to create storage entry for credentials index")
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func deleteCredsIndex(ctx context.Context, s logical.Storage, user string) error {
+	return s.Delete(ctx, credsIndexStoragePrefix+user)
+}
+
+// trackCreds adds the token of the entry to the credentials index.
+// When the user is already tracked, the token is added to the record.
+func (b *thingsDBBackend) trackCreds(ctx context.Context, s logical.Storage, entry *thingsDBCredsIndexEntry) error {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	existing, err := getCredsIndex(ctx, s, entry.User)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		entry.TokenIDs = append(existing.TokenIDs, entry.TokenIDs...)
+		entry.CreatedAt = existing.CreatedAt
+		if existing.Expiration.After(entry.Expiration) {
+			entry.Expiration = existing.Expiration
+		}
+	}
+
+	return setCredsIndex(ctx, s, entry)
+}
+
+// untrackCreds removes the token from the credentials index. The record
+// of the user is deleted together with its last token, or right away
+// when the token is unknown.
+func (b *thingsDBBackend) untrackCreds(ctx context.Context, s logical.Storage, user string, tokenID string) error {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	entry, err := getCredsIndex(ctx, s, user)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	if tokenID != "" {
+		tokenIDs := make([]string, 0, len(entry.TokenIDs))
+		for _, id := range entry.TokenIDs {
+			if id != tokenID {
+				tokenIDs = append(tokenIDs, id)
+			}
+		}
+
+		if len(tokenIDs) > 0 {
+			entry.TokenIDs = tokenIDs
+			return setCredsIndex(ctx, s, entry)
+		}
+	}
+
+	return deleteCredsIndex(ctx, s, user)
+}
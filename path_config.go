@@ -2,8 +2,10 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -16,10 +18,21 @@ const (
 // thingsDBConfig includes the minimum configuration
 // required to instantiate a new FortiOS client.
 type thingsDBConfig struct {
-	Hostname string `json:"hostname"`
-	Port     string `json:"port"`
-	Token    string `json:"token"`
-	Insecure bool   `json:"insecure"`
+	Hostname   string   `json:"hostname"`
+	Port       string   `json:"port"`
+	Nodes      []string `json:"nodes"`
+	Token      string   `json:"token"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Insecure   bool     `json:"insecure"`
+	TLSEnabled bool     `json:"tls_enabled"`
+	CACert     string   `json:"ca_cert"`
+	ServerName string   `json:"server_name"`
+	ClientCert string   `json:"client_cert"`
+	ClientKey  string   `json:"client_key"`
+
+	RootRotationPeriod time.Duration `json:"root_rotation_period"`
+	LastRotated        time.Time     `json:"last_rotated"`
 }
 
 // pathConfig extends the Vault API with
@@ -30,8 +43,8 @@ func pathConfig(b *thingsDBBackend) *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"hostname": {
 				Type:        framework.TypeString,
-				Description: "The hostname of the ThingsDB cluster",
-				Required:    true,
+				Description: "The hostname of the ThingsDB cluster, shorthand for a single node",
+				Required:    false,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name:      "Hostname",
 					Sensitive: false,
@@ -39,22 +52,49 @@ func pathConfig(b *thingsDBBackend) *framework.Path {
 			},
 			"port": {
 				Type:        framework.TypeString,
-				Description: "The port of the ThingsDB cluster",
-				Required:    true,
+				Description: "The port of the ThingsDB cluster, shorthand for a single node",
+				Required:    false,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name:      "Port",
 					Sensitive: false,
 				},
 			},
+			"nodes": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "List of host:port pairs of the ThingsDB cluster nodes. Takes precedence over hostname and port",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Nodes",
+					Sensitive: false,
+				},
+			},
 			"token": {
 				Type:        framework.TypeString,
-				Description: "ThingsDB token to use for communications",
-				Required:    true,
+				Description: "ThingsDB token to use for communications. Cannot be combined with username and password",
+				Required:    false,
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name:      "Token",
 					Sensitive: true,
 				},
 			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "ThingsDB user to authenticate with, as an alternative to token",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Username",
+					Sensitive: false,
+				},
+			},
+			"password": {
+				Type:        framework.TypeString,
+				Description: "Password of the ThingsDB user",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Password",
+					Sensitive: true,
+				},
+			},
 			"insecure": {
 				Type:        framework.TypeBool,
 				Description: "Skip TLS verification when connecting to ThingsDB",
@@ -64,6 +104,70 @@ func pathConfig(b *thingsDBBackend) *framework.Path {
 					Sensitive: false,
 				},
 			},
+			"tls_enabled": {
+				Type:        framework.TypeBool,
+				Description: "Use TLS when connecting to ThingsDB",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "TLS Enabled",
+					Sensitive: false,
+				},
+			},
+			"ca_cert": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded CA certificate used to verify the ThingsDB server certificate",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "CA Certificate",
+					Sensitive: false,
+				},
+			},
+			"server_name": {
+				Type:        framework.TypeString,
+				Description: "Server name used to verify the ThingsDB server certificate, defaults to the hostname",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Server Name",
+					Sensitive: false,
+				},
+			},
+			"client_cert": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded client certificate used for mutual TLS with ThingsDB",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Client Certificate",
+					Sensitive: true,
+				},
+			},
+			"client_key": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded private key matching client_cert",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Client Key",
+					Sensitive: true,
+				},
+			},
+			"root_rotation_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Rotate the ThingsDB token or password of the backend automatically after this period. If not set or set to 0, it is not rotated automatically.",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Root Rotation Period",
+					Sensitive: false,
+				},
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "Verify the connection and privileges of the credentials before saving the config",
+				Default:     true,
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Verify Connection",
+					Sensitive: false,
+				},
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -100,16 +204,36 @@ func (b *thingsDBBackend) pathConfigRead(ctx context.Context, req *logical.Reque
 		return nil, err
 	}
 
+	if config == nil {
+		return nil, nil
+	}
+
+	lastRotated := ""
+	if !config.LastRotated.IsZero() {
+		lastRotated = config.LastRotated.Format(time.RFC3339)
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"hostname": config.Hostname,
-			"port":     config.Port,
-			"insecure": config.Insecure,
+			"hostname":             config.Hostname,
+			"port":                 config.Port,
+			"nodes":                config.Nodes,
+			"username":             config.Username,
+			"insecure":             config.Insecure,
+			"tls_enabled":          config.TLSEnabled,
+			"ca_cert":              config.CACert,
+			"server_name":          config.ServerName,
+			"root_rotation_period": config.RootRotationPeriod.Seconds(),
+			"last_rotated":         lastRotated,
 		},
 	}, nil
 }
 
 func (b *thingsDBBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Never let a running root rotation overwrite the new config
+	b.rootLock.Lock()
+	defer b.rootLock.Unlock()
+
 	config, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
@@ -124,22 +248,54 @@ func (b *thingsDBBackend) pathConfigWrite(ctx context.Context, req *logical.Requ
 		config = new(thingsDBConfig)
 	}
 
+	if nodes, ok := data.GetOk("nodes"); ok {
+		config.Nodes = nodes.([]string)
+	}
+
 	if hostname, ok := data.GetOk("hostname"); ok {
 		config.Hostname = hostname.(string)
-	} else if createOperation {
-		return nil, fmt.Errorf("missing username in configuration")
+	} else if createOperation && len(config.Nodes) == 0 {
+		return nil, fmt.Errorf("missing hostname in configuration")
 	}
 
 	if port, ok := data.GetOk("port"); ok {
 		config.Port = port.(string)
-	} else if createOperation {
+	} else if createOperation && len(config.Nodes) == 0 {
 		return nil, fmt.Errorf("missing port in configuration")
 	}
 
-	if token, ok := data.GetOk("token"); ok {
+	if _, err := config.nodes(); err != nil {
+		return logical.ErrorResponse("invalid node configuration: %s", err), nil
+	}
+
+	token, tokenOk := data.GetOk("token")
+	username, usernameOk := data.GetOk("username")
+	password, passwordOk := data.GetOk("password")
+
+	switch {
+	case tokenOk && (usernameOk || passwordOk):
+		return logical.ErrorResponse("token cannot be combined with username and password"), nil
+	case tokenOk:
 		config.Token = token.(string)
-	} else if createOperation {
-		return nil, fmt.Errorf("missing token in configuration")
+		config.Username = ""
+		config.Password = ""
+		// Credentials provided by hand have never been rotated by Vault
+		config.LastRotated = time.Time{}
+	case usernameOk || passwordOk:
+		if usernameOk {
+			config.Username = username.(string)
+		}
+		if passwordOk {
+			config.Password = password.(string)
+		}
+		config.Token = ""
+		config.LastRotated = time.Time{}
+	case createOperation:
+		return nil, fmt.Errorf("missing token or username and password in configuration")
+	}
+
+	if config.Token == "" && (config.Username == "" || config.Password == "") {
+		return logical.ErrorResponse("either token or both username and password must be set"), nil
 	}
 
 	if insecure, ok := data.GetOk("insecure"); ok {
@@ -148,12 +304,51 @@ func (b *thingsDBBackend) pathConfigWrite(ctx context.Context, req *logical.Requ
 		return nil, fmt.Errorf("missing insecure flag from config")
 	}
 
-	entry, err := logical.StorageEntryJSON(configStoragePath, config)
-	if err != nil {
-		return nil, err
+	if rotationPeriod, ok := data.GetOk("root_rotation_period"); ok {
+		config.RootRotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if config.RootRotationPeriod < 0 {
+		return logical.ErrorResponse("root_rotation_period cannot be negative"), nil
+	}
+
+	if tlsEnabled, ok := data.GetOk("tls_enabled"); ok {
+		config.TLSEnabled = tlsEnabled.(bool)
+	}
+
+	if caCert, ok := data.GetOk("ca_cert"); ok {
+		config.CACert = caCert.(string)
+	}
+
+	if serverName, ok := data.GetOk("server_name"); ok {
+		config.ServerName = serverName.(string)
+	}
+
+	if clientCert, ok := data.GetOk("client_cert"); ok {
+		config.ClientCert = clientCert.(string)
 	}
 
-	if err = req.Storage.Put(ctx, entry); err != nil {
+	if clientKey, ok := data.GetOk("client_key"); ok {
+		config.ClientKey = clientKey.(string)
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if _, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey)); err != nil {
+			return logical.ErrorResponse("invalid client certificate and key pair: %s", err), nil
+		}
+	}
+
+	if _, err := newTLSConfig(config); err != nil {
+		return logical.ErrorResponse("invalid TLS configuration: %s", err), nil
+	}
+
+	if data.Get("verify_connection").(bool) {
+		if err := b.verifyConnection(config); err != nil {
+			return logical.ErrorResponse("error verifying connection: %s", err), nil
+		}
+	}
+
+	if err := setConfig(ctx, req.Storage, config); err != nil {
 		return nil, err
 	}
 
@@ -162,7 +357,22 @@ func (b *thingsDBBackend) pathConfigWrite(ctx context.Context, req *logical.Requ
 	return nil, nil
 }
 
+// verifyConnection opens a separate connection using the given config
+// and checks the privileges of the configured credentials.
+func (b *thingsDBBackend) verifyConnection(config *thingsDBConfig) error {
+	client, err := b.newClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.verifyPrivileges()
+}
+
 func (b *thingsDBBackend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.rootLock.Lock()
+	defer b.rootLock.Unlock()
+
 	err := req.Storage.Delete(ctx, configStoragePath)
 
 	if err == nil {
@@ -172,6 +382,15 @@ func (b *thingsDBBackend) pathConfigDelete(ctx context.Context, req *logical.Req
 	return nil, err
 }
 
+func setConfig(ctx context.Context, s logical.Storage, config *thingsDBConfig) error {
+	entry, err := logical.StorageEntryJSON(configStoragePath, config)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
 func getConfig(ctx context.Context, s logical.Storage) (*thingsDBConfig, error) {
 	entry, err := s.Get(ctx, configStoragePath)
 	if err != nil {
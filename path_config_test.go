@@ -2,12 +2,22 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -24,6 +34,7 @@ func TestConfig(t *testing.T) {
 
 	t.Run("Test configuration", func(t *testing.T) {
 		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
 			"hostname": hostname,
 			"port": port,
 			"insecure": insecure,
@@ -35,12 +46,20 @@ func TestConfig(t *testing.T) {
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
 			"hostname": hostname,
 			"port": port,
+			"nodes": []string(nil),
+			"username": "",
 			"insecure": insecure,
+			"tls_enabled": false,
+			"ca_cert": "",
+			"server_name": "",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
 		})
 
 		assert.NoError(t, err)
 
 		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
 			"hostname": hostname,
 			"insecure": false,
 		})
@@ -50,7 +69,14 @@ func TestConfig(t *testing.T) {
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
 			"hostname": hostname,
 			"port": port,
+			"nodes": []string(nil),
+			"username": "",
 			"insecure": false,
+			"tls_enabled": false,
+			"ca_cert": "",
+			"server_name": "",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
 		})
 
 		assert.NoError(t, err)
@@ -59,6 +85,350 @@ func TestConfig(t *testing.T) {
 
 		assert.NoError(t, err)
 	}) 
+
+	t.Run("Test TLS configuration", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": false,
+			"token": token,
+			"tls_enabled": true,
+			"server_name": "thingsdb.local",
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"nodes": []string(nil),
+			"username": "",
+			"insecure": false,
+			"tls_enabled": true,
+			"ca_cert": "",
+			"server_name": "thingsdb.local",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"ca_cert": "not a certificate",
+		})
+
+		assert.Error(t, err)
+
+		err = testConfigDelete(t, b, reqStorage)
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Test client certificate configuration", func(t *testing.T) {
+		certPEM, keyPEM := testClientCertificate(t)
+		_, otherKeyPEM := testClientCertificate(t)
+
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": false,
+			"token": token,
+			"tls_enabled": true,
+			"client_cert": certPEM,
+			"client_key": keyPEM,
+		})
+
+		assert.NoError(t, err)
+
+		// client_cert and client_key must never be returned
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"nodes": []string(nil),
+			"username": "",
+			"insecure": false,
+			"tls_enabled": true,
+			"ca_cert": "",
+			"server_name": "",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"client_key": otherKeyPEM,
+		})
+
+		assert.Error(t, err)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"client_cert": "",
+		})
+
+		assert.Error(t, err)
+
+		err = testConfigDelete(t, b, reqStorage)
+
+		assert.NoError(t, err)
+	})
+}
+
+// TestConfigNodes checks the multi-node cluster configuration.
+func TestConfigNodes(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+
+	t.Run("Test nodes configuration", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"nodes": "node1.local:9200,node2.local:9200,[::1]:9201",
+			"insecure": false,
+			"token": token,
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"hostname": "",
+			"port": "",
+			"nodes": []string{"node1.local:9200", "node2.local:9200", "[::1]:9201"},
+			"username": "",
+			"insecure": false,
+			"tls_enabled": false,
+			"ca_cert": "",
+			"server_name": "",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
+		})
+
+		assert.NoError(t, err)
+
+		config, err := getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		nodes, err := config.nodes()
+		require.NoError(t, err)
+		assert.Equal(t, []thingsDBNode{
+			{host: "node1.local", port: 9200},
+			{host: "node2.local", port: 9200},
+			{host: "::1", port: 9201},
+		}, nodes)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"nodes": []string{"node1.local"},
+		})
+
+		assert.Error(t, err)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"nodes": []string{"node1.local:99999"},
+		})
+
+		assert.Error(t, err)
+
+		err = testConfigDelete(t, b, reqStorage)
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Test missing nodes and hostname", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"insecure": false,
+			"token": token,
+		})
+
+		assert.Error(t, err)
+	})
+}
+
+// TestConfigVerifyConnection checks that the connection and
+// privileges are verified before the config is saved.
+func TestConfigVerifyConnection(t *testing.T) {
+	privileges := func(p string) *fakeConn {
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return p, nil
+		}
+		return conn
+	}
+
+	t.Run("Test sufficient privileges", func(t *testing.T) {
+		b, reqStorage := getTestBackend(t)
+		conn := privileges("QUERY|CHANGE|GRANT")
+		useFakeConns(b, conn)
+
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"token": token,
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{privilegeProbeQuery}, conn.Queries())
+		assert.False(t, conn.IsConnected())
+	})
+
+	t.Run("Test insufficient privileges", func(t *testing.T) {
+		b, reqStorage := getTestBackend(t)
+		useFakeConns(b, privileges("QUERY|CHANGE"))
+
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"token": token,
+		})
+
+		assert.ErrorContains(t, err, "GRANT")
+
+		config, err := getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("Test connection failure", func(t *testing.T) {
+		b, reqStorage := getTestBackend(t)
+		useFakeConns(b)
+
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"token": token,
+		})
+
+		assert.Error(t, err)
+
+		config, err := getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		assert.Nil(t, config)
+	})
+}
+
+// TestConfigPasswordAuth checks that exactly one
+// authentication method is configured.
+func TestConfigPasswordAuth(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+
+	t.Run("Test username and password", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"username": "admin",
+			"password": "pass",
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"hostname": hostname,
+			"port": port,
+			"nodes": []string(nil),
+			"username": "admin",
+			"insecure": insecure,
+			"tls_enabled": false,
+			"ca_cert": "",
+			"server_name": "",
+			"root_rotation_period": float64(0),
+			"last_rotated": "",
+		})
+
+		assert.NoError(t, err)
+
+		// Switching to a token clears the username and password
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"token": token,
+		})
+
+		assert.NoError(t, err)
+
+		config, err := getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		assert.Equal(t, token, config.Token)
+		assert.Empty(t, config.Username)
+		assert.Empty(t, config.Password)
+
+		err = testConfigDelete(t, b, reqStorage)
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Test token combined with password", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"token": token,
+			"username": "admin",
+			"password": "pass",
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Test username without password", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+			"username": "admin",
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Test missing credentials", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"verify_connection": false,
+			"hostname": hostname,
+			"port": port,
+			"insecure": insecure,
+		})
+
+		assert.Error(t, err)
+	})
+}
+
+// testClientCertificate generates a self-signed PEM encoded
+// certificate and matching private key.
+func testClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vault"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return string(certPEM), string(keyPEM)
 }
 
 func testConfigDelete(t *testing.T, b logical.Backend, s logical.Storage) error {
@@ -143,7 +513,7 @@ func testConfigRead(t *testing.T, b logical.Backend, s logical.Storage, expected
 
 		if !ok {
 			return fmt.Errorf(`expected data["%s"] = %v but was not included in read output"`, k, expectedV)
-		} else if expectedV != actualV {
+		} else if !reflect.DeepEqual(expectedV, actualV) {
 			return fmt.Errorf(`expected data["%s"] = %v, instead got %v"`, k, expectedV, actualV)
 		}
 	}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -34,16 +36,61 @@ func pathCredentials(b *thingsDBBackend) *framework.Path {
 	}
 }
 
-func (b *thingsDBBackend) createToken(ctx context.Context, s logical.Storage, roleEntry *thingsDBRoleEntry) (*thingsDBToken, error) {
-	client, err := b.getClient(ctx, s)
+// maxUsernameAttempts bounds how often a new username is generated
+// when the name already exists in ThingsDB.
+const maxUsernameAttempts = 5
+
+func (b *thingsDBBackend) createToken(ctx context.Context, req *logical.Request, roleEntry *thingsDBRoleEntry) (*thingsDBToken, error) {
+	for attempt := 1; ; attempt++ {
+		token, err := b.createUserToken(ctx, req, roleEntry)
+		if err != nil && isUserExistsError(err) && attempt < maxUsernameAttempts {
+			b.Logger().Debug("generated username already exists, retrying", "attempt", attempt)
+			continue
+		}
+		return token, err
+	}
+}
+
+func (b *thingsDBBackend) createUserToken(ctx context.Context, req *logical.Request, roleEntry *thingsDBRoleEntry) (*thingsDBToken, error) {
+	var token *thingsDBToken
+
+	username, err := generateUsername(roleEntry, req)
 	if err != nil {
 		return nil, err
 	}
 
-	var token *thingsDBToken
+	expiration := b.tokenExpiration(roleEntry)
+	tokenID := uuid.New().String()
+
+	// Track the user in a WAL entry, so it gets deleted by the
+	// rollback when creating the credentials fails halfway. Users
+	// of roles which only delete the token are shared, so for those
+	// only the token gets deleted.
+	walID, err := framework.PutWAL(ctx, req.Storage, walTypeUser, &walUser{
+		User:           username,
+		TokenID:        tokenID,
+		RevocationMode: roleEntry.revocationMode(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing WAL entry: %w", err)
+	}
 
-	token, err = createToken(client, roleEntry.Target, roleEntry.Mask)
+	queries := 0
+	err = b.withClient(ctx, req.Storage, func(client *thingsDBClient) error {
+		var err error
+		queries++
+		token, err = createToken(client, username, tokenID, roleEntry.grants(), roleEntry.CreationStatements, expiration)
+		return err
+	})
 	if err != nil {
+		// The user belongs to someone else, so it must never be deleted
+		// by the rollback. When the query was retried, the first attempt
+		// may have created the user, so the WAL entry is kept.
+		if isUserExistsError(err) && queries == 1 {
+			if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+				return nil, fmt.Errorf("error deleting WAL entry: %w", err)
+			}
+		}
 		return nil, fmt.Errorf("error creating token: %w", err)
 	}
 
@@ -51,11 +98,45 @@ func (b *thingsDBBackend) createToken(ctx context.Context, s logical.Storage, ro
 		return nil, errors.New("error creating token: no token returned")
 	}
 
+	// Track the user, so tidy does not take it for an orphan. When this
+	// fails, the WAL entry is kept and the user gets rolled back.
+	err = b.trackCreds(ctx, req.Storage, &thingsDBCredsIndexEntry{
+		User:        token.User,
+		Role:        roleEntry.Name,
+		TokenIDs:    []string{token.TokenID},
+		CreatedAt:   time.Now(),
+		Expiration:  token.Expiration,
+		DisplayName: req.DisplayName,
+		EntityID:    req.EntityID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error tracking user: %w", err)
+	}
+
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, fmt.Errorf("error deleting WAL entry: %w", err)
+	}
+
 	return token, nil
 }
 
+// tokenExpiration returns when a token for the role must expire in
+// ThingsDB, which is the longest a lease for the role may live.
+func (b *thingsDBBackend) tokenExpiration(roleEntry *thingsDBRoleEntry) time.Time {
+	maxTTL := roleEntry.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = b.System().MaxLeaseTTL()
+	}
+
+	if maxTTL <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(maxTTL)
+}
+
 func (b *thingsDBBackend) createUserCreds(ctx context.Context, req *logical.Request, role *thingsDBRoleEntry) (*logical.Response, error) {
-	token, err := b.createToken(ctx, req.Storage, role)
+	token, err := b.createToken(ctx, req, role)
 	if err != nil {
 		return nil, err
 	}
@@ -65,11 +146,16 @@ func (b *thingsDBBackend) createUserCreds(ctx context.Context, req *logical.Requ
 		"token_id": token.TokenID,
 		"user":     token.User,
 	}, map[string]interface{}{
-		"token": token.Token,
-		"role":  role.Name,
-		"user":  token.User,
+		"role":            role.Name,
+		"user":            token.User,
+		"token_id":        token.TokenID,
+		"revocation_mode": role.revocationMode(),
 	})
 
+	if !token.Expiration.IsZero() {
+		resp.Secret.InternalData["expiration"] = token.Expiration.Unix()
+	}
+
 	if role.TTL > 0 {
 		resp.Secret.TTL = role.TTL
 	}
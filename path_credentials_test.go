@@ -2,13 +2,20 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+	ti "github.com/thingsdb/go-thingsdb"
 )
 
 // newAcceptanceTestEnv creates a new test environment for credentials
@@ -58,4 +65,697 @@ func TestAcceptanceUserToken(t *testing.T) {
 	t.Run("read user token cred", acceptanceTestEnv.ReadUserToken)
 	t.Run("read user token cred", acceptanceTestEnv.ReadUserToken)
 	t.Run("cleanup user tokens", acceptanceTestEnv.CleanupUserTokens)
-}
\ No newline at end of file
+}
+
+// newFakeCredsConn returns a fake connection answering
+// the queries used to create and revoke credentials.
+func newFakeCredsConn() *fakeConn {
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		switch {
+		case code == createTokenQuery:
+			return "faketoken", nil
+		case strings.HasPrefix(code, "has_user("):
+			return true, nil
+		}
+		return nil, nil
+	}
+	return conn
+}
+
+// TestCreateToken checks that users are provisioned
+// in a single query.
+func TestCreateToken(t *testing.T) {
+	t.Run("Single query", func(t *testing.T) {
+		conn := newFakeCredsConn()
+		expiration := time.Now().Add(time.Hour)
+
+		grants := []thingsDBGrant{
+			{Target: target, Mask: mask},
+			{Target: "//orders", Mask: "16"},
+		}
+
+		token, err := createToken(&thingsDBClient{conn}, "user_1", "token_1", grants, nil, expiration)
+		require.NoError(t, err)
+		require.Equal(t, "faketoken", token.Token)
+		require.Equal(t, "user_1", token.User)
+		require.Equal(t, []string{createTokenQuery}, conn.Queries())
+		require.Equal(t, map[string]interface{}{
+			"user": "user_1",
+			"grants": []interface{}{
+				map[string]interface{}{"target": target, "mask": 31},
+				map[string]interface{}{"target": "//orders", "mask": 16},
+			},
+			"expiration": expiration.Unix(),
+			"token_id": token.TokenID,
+		}, conn.Vars()[0])
+	})
+
+	t.Run("No expiration", func(t *testing.T) {
+		conn := newFakeCredsConn()
+
+		_, err := createToken(&thingsDBClient{conn}, "user_1", "token_1", []thingsDBGrant{{Target: target, Mask: mask}}, nil, time.Time{})
+		require.NoError(t, err)
+		require.Nil(t, conn.Vars()[0]["expiration"])
+	})
+
+	t.Run("Invalid mask", func(t *testing.T) {
+		conn := newFakeCredsConn()
+
+		_, err := createToken(&thingsDBClient{conn}, "user_1", "token_1", []thingsDBGrant{{Target: target, Mask: "3l"}}, nil, time.Time{})
+		require.Error(t, err)
+		require.Empty(t, conn.Queries())
+	})
+
+	t.Run("Query error", func(t *testing.T) {
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("lookup error")
+		}
+
+		_, err := createToken(&thingsDBClient{conn}, "user_1", "token_1", []thingsDBGrant{{Target: target, Mask: mask}}, nil, time.Time{})
+		require.EqualError(t, err, "lookup error")
+	})
+
+	t.Run("Unexpected response", func(t *testing.T) {
+		conn := newFakeConn()
+
+		_, err := createToken(&thingsDBClient{conn}, "user_1", "token_1", []thingsDBGrant{{Target: target, Mask: mask}}, nil, time.Time{})
+		require.Error(t, err)
+	})
+}
+
+// TestCredentialsExpiration checks that tokens expire in ThingsDB
+// together with the longest possible lease.
+func TestCredentialsExpiration(t *testing.T) {
+	b, s := getTestBackend(t)
+	conn := newFakeCredsConn()
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target":  target,
+		"mask":    mask,
+		"ttl":     testTTL,
+		"max_ttl": testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + roleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+	require.Equal(t, "faketoken", resp.Data["token"])
+
+	vars := conn.Vars()
+	require.Len(t, vars, 1)
+	expected := time.Now().Add(time.Duration(testMaxTTL) * time.Second).Unix()
+	require.InDelta(t, expected, vars[0]["expiration"], 5)
+	require.Equal(t, vars[0]["expiration"], resp.Secret.InternalData["expiration"])
+	require.NotContains(t, resp.Secret.InternalData, "token")
+
+	t.Run("Renew within expiration", func(t *testing.T) {
+		secret := *resp.Secret
+		secret.IssueTime = time.Now()
+
+		renewed, err := b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  &secret,
+		}, nil)
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(testTTL)*time.Second, renewed.Secret.TTL)
+		require.InDelta(t, time.Duration(testMaxTTL)*time.Second, renewed.Secret.MaxTTL, float64(5*time.Second))
+	})
+
+	t.Run("Renew capped by expiration", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"max_ttl": "5h",
+		})
+		require.NoError(t, err)
+
+		secret := *resp.Secret
+		secret.IssueTime = time.Now()
+
+		renewed, err := b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  &secret,
+		}, nil)
+		require.NoError(t, err)
+		require.InDelta(t, time.Duration(testMaxTTL)*time.Second, renewed.Secret.MaxTTL, float64(5*time.Second))
+		require.Len(t, renewed.Warnings, 1)
+	})
+}
+
+// TestCredentialsRenew checks that a lease is only renewed
+// while the credential still exists in ThingsDB.
+func TestCredentialsRenew(t *testing.T) {
+	b, s := getTestBackend(t)
+	conn := newFakeCredsConn()
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target":  target,
+		"mask":    mask,
+		"ttl":     testTTL,
+		"max_ttl": testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + roleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	renew := func() (*logical.Response, error) {
+		secret := *resp.Secret
+		secret.IssueTime = time.Now()
+		return b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  &secret,
+		}, nil)
+	}
+
+	t.Run("Renew existing user", func(t *testing.T) {
+		renewed, err := renew()
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(testTTL)*time.Second, renewed.Secret.TTL)
+		require.Contains(t, conn.Queries(), "has_user({user});")
+	})
+
+	t.Run("Renew removed user", func(t *testing.T) {
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return false, nil
+		}
+		_, err := renew()
+		require.ErrorContains(t, err, "no longer exists")
+	})
+
+	t.Run("Renew expired token", func(t *testing.T) {
+		secret := *resp.Secret
+		secret.InternalData = map[string]interface{}{
+			"role":       roleName,
+			"user":       resp.Data["user"],
+			"expiration": time.Now().Add(-time.Minute).Unix(),
+		}
+		_, err := b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  &secret,
+		}, nil)
+		require.ErrorContains(t, err, "expired")
+	})
+
+	t.Run("Renew deleted role", func(t *testing.T) {
+		_, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+
+		_, err = renew()
+		require.ErrorContains(t, err, "has been deleted")
+	})
+}
+
+// TestCredentialsStatements checks that the creation and revocation
+// statements of a role replace the default queries.
+func TestCredentialsStatements(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		switch {
+		case strings.HasPrefix(code, "\nexisted = has_user(name);"):
+			return "faketoken", nil
+		case code == tokenKeyQuery:
+			return "faketoken", nil
+		}
+		return nil, nil
+	}
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target": target,
+		"mask":   mask,
+		"creation_statements": []string{
+			"new_user({{name}})",
+			"set_user_meta({{name}}, 'app');",
+			"grants.each(|g| grant(g.target, {{name}}, g.mask));",
+			"new_token({{name}}, {{expiration}}, {{token_id}});",
+		},
+		"revocation_statements": []string{"del_token({{token}});", "del_user({{name}});"},
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + roleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "faketoken", resp.Data["token"])
+
+	require.Contains(t, conn.Queries()[0], `
+new_user(name);
+set_user_meta(name, 'app');
+grants.each(|g| grant(g.target, name, g.mask));
+new_token(name, expiration, token_id);
+`)
+	require.Equal(t, resp.Data["user"], conn.Vars()[0]["name"])
+	require.Equal(t, []interface{}{map[string]interface{}{"target": target, "mask": 31}}, conn.Vars()[0]["grants"])
+
+	require.NotContains(t, resp.Secret.InternalData, "token")
+	tokenID := resp.Secret.InternalData["token_id"]
+	require.Equal(t, tokenID, conn.Vars()[0]["token_id"])
+
+	// The token is looked up by its ID when revoking
+	_, err = b.tokenRevoke(context.Background(), &logical.Request{
+		Storage: s,
+		Secret:  resp.Secret,
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, tokenKeyQuery, conn.Queries()[1])
+	require.Equal(t, tokenID, conn.Vars()[1]["token_id"])
+	require.Equal(t, "del_token(token);\ndel_user(name);", conn.Queries()[2])
+	require.Equal(t, "faketoken", conn.Vars()[2]["token"])
+	require.Equal(t, tokenID, conn.Vars()[2]["token_id"])
+	require.Equal(t, resp.Data["user"], conn.Vars()[2]["name"])
+
+	t.Run("Lease of an older version", func(t *testing.T) {
+		queries := len(conn.Queries())
+
+		_, err = b.tokenRevoke(context.Background(), &logical.Request{
+			Storage: s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"token": "oldtoken",
+					"role":  roleName,
+					"user":  "olduser",
+				},
+			},
+		}, nil)
+		require.NoError(t, err)
+		require.Len(t, conn.Queries(), queries+1)
+		require.Equal(t, "oldtoken", conn.Vars()[queries]["token"])
+		require.Equal(t, "olduser", conn.Vars()[queries]["name"])
+	})
+
+	t.Run("Deleted role", func(t *testing.T) {
+		_, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+
+		_, err = b.tokenRevoke(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  resp.Secret,
+		}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "del_user({user});", conn.Queries()[len(conn.Queries())-1])
+	})
+}
+
+// TestCredentialsUsernameTemplate checks that users are
+// named after the username template of the role.
+func TestCredentialsUsernameTemplate(t *testing.T) {
+	b, s := getTestBackend(t)
+	conn := newFakeCredsConn()
+	useFakeConns(b, conn)
+
+	readCreds := func(displayName string) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:   logical.ReadOperation,
+			Path:        "creds/" + roleName,
+			Storage:     s,
+			DisplayName: displayName,
+			EntityID:    "entity1",
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Default template", func(t *testing.T) {
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask":   mask,
+		})
+		require.NoError(t, err)
+
+		user := readCreds("token-app").Data["user"].(string)
+		require.Regexp(t, `^v_token-ap_testthin_[0-9A-Za-z]{20}_[0-9]+$`, user)
+		require.Equal(t, user, conn.Vars()[0]["user"])
+	})
+
+	t.Run("Default template sanitizes display name", func(t *testing.T) {
+		user := readCreds("J. Doe/ü").Data["user"].(string)
+		require.Regexp(t, `^v_J\._Doe___testthin_[0-9A-Za-z]{20}_[0-9]+$`, user)
+	})
+
+	t.Run("Custom template", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"username_template": "{{.RoleName | uppercase}}_{{.EntityID}}_{{random 4}}",
+		})
+		require.NoError(t, err)
+
+		user := readCreds("token-app").Data["user"].(string)
+		require.Regexp(t, `^TESTTHINGSDB_entity1_[0-9A-Za-z]{4}$`, user)
+	})
+}
+
+// newFakeUserServer returns a fake connection which keeps track of
+// the users in ThingsDB and rejects users which already exist.
+func newFakeUserServer(users map[string]bool) *fakeConn {
+	var mu sync.Mutex
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		user, _ := vars["user"].(string)
+		switch {
+		case code == createTokenQuery:
+			if users[user] {
+				return nil, ti.NewTiError(fmt.Sprintf("user `%s` already exists", user), ti.LookupError)
+			}
+			users[user] = true
+			return "token_" + user, nil
+		case strings.HasPrefix(code, "has_user("):
+			return users[user], nil
+		case strings.HasPrefix(code, "del_user("):
+			delete(users, user)
+		}
+		return nil, nil
+	}
+	return conn
+}
+
+// TestCredentialsConcurrent checks that credentials issued in
+// parallel never end up with the same user.
+func TestCredentialsConcurrent(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	users := map[string]bool{}
+	useFakeConns(b, newFakeUserServer(users))
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target": target,
+		"mask":   mask,
+	})
+	require.NoError(t, err)
+
+	const count = 500
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	tokens := make(chan string, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/" + roleName,
+				Storage:   s,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			tokens <- resp.Data["token"].(string)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(tokens)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	unique := map[string]bool{}
+	for token := range tokens {
+		unique[token] = true
+	}
+	require.Len(t, unique, count)
+	require.Len(t, users, count)
+
+	walIDs, err := framework.ListWAL(context.Background(), s)
+	require.NoError(t, err)
+	require.Empty(t, walIDs)
+}
+
+// TestCredentialsUsernameCollision checks that a new username is
+// generated when the user already exists in ThingsDB, without
+// ever deleting the existing user.
+func TestCredentialsUsernameCollision(t *testing.T) {
+	t.Run("Retry with a new name", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		// The first two generated names already exist
+		attempts := 0
+		conn := newFakeCredsConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			if code != createTokenQuery {
+				return nil, nil
+			}
+			attempts++
+			if attempts <= 2 {
+				return nil, ti.NewTiError(fmt.Sprintf("user `%s` already exists", vars["user"]), ti.LookupError)
+			}
+			return "faketoken", nil
+		}
+		useFakeConns(b, conn)
+
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask":   mask,
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "faketoken", resp.Data["token"])
+		require.Equal(t, 3, attempts)
+
+		vars := conn.Vars()
+		require.NotEqual(t, vars[0]["user"], vars[1]["user"])
+		require.NotEqual(t, vars[1]["user"], vars[2]["user"])
+		require.Equal(t, vars[2]["user"], resp.Data["user"])
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	})
+
+	t.Run("Give up after max attempts", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		users := map[string]bool{"app": true}
+		conn := newFakeUserServer(users)
+		useFakeConns(b, conn)
+
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target":            target,
+			"mask":              mask,
+			"username_template": "app",
+		})
+		require.NoError(t, err)
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.ErrorContains(t, err, "already exists")
+		require.Len(t, conn.Queries(), maxUsernameAttempts)
+		require.True(t, users["app"])
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	})
+
+	t.Run("Collision after a retried query", func(t *testing.T) {
+		ctx := context.Background()
+		b, s := getTestBackend(t)
+
+		// The user gets created, but the response times out, so the
+		// query is retried on a new connection and the user exists
+		users := map[string]bool{}
+		conn := newFakeUserServer(users)
+		timedOut := newFakeConn()
+		timedOut.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			if _, err := conn.QueryFunc(scope, code, vars); err != nil {
+				return nil, err
+			}
+			return nil, ti.NewTiError("request timed out", ti.RequestTimeoutError)
+		}
+		useFakeConns(b, timedOut, conn)
+
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask":   mask,
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+
+		// The user of the first attempt is still rolled back
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 1)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RollbackOperation,
+			Storage:   s,
+			Data:      map[string]interface{}{"immediate": true},
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]bool{resp.Data["user"].(string): true}, users)
+	})
+}
+
+// TestCredentialsRevocationMode checks that revoking credentials
+// of a shared user only deletes the token of the lease.
+func TestCredentialsRevocationMode(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+
+	// Tokens of the shared user by their description
+	var mu sync.Mutex
+	tokens := map[string]string{}
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(code, "\nexisted = has_user(name);"):
+			key := fmt.Sprintf("key_%d", len(tokens))
+			tokens[vars["token_id"].(string)] = key
+			return key, nil
+		case code == deleteUserTokenQuery:
+			for description, key := range tokens {
+				if key == vars["token"] || description == vars["token_id"] {
+					delete(tokens, description)
+				}
+			}
+		}
+		return nil, nil
+	}
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target":              target,
+		"mask":                mask,
+		"username_template":   "service",
+		"creation_statements": []string{"new_token({{name}}, {{expiration}}, {{token_id}});"},
+		"revocation_mode":     revocationModeDeleteToken,
+	})
+	require.NoError(t, err)
+
+	var leases []*logical.Secret
+	for i := 0; i < 2; i++ {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "service", resp.Data["user"])
+		leases = append(leases, resp.Secret)
+	}
+	require.Len(t, tokens, 2)
+
+	index, err := getCredsIndex(ctx, s, "service")
+	require.NoError(t, err)
+	require.Len(t, index.TokenIDs, 2)
+
+	_, err = b.tokenRevoke(ctx, &logical.Request{Storage: s, Secret: leases[0]}, nil)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Contains(t, tokens, leases[1].InternalData["token_id"])
+
+	index, err = getCredsIndex(ctx, s, "service")
+	require.NoError(t, err)
+	require.Equal(t, []string{leases[1].InternalData["token_id"].(string)}, index.TokenIDs)
+
+	_, err = b.tokenRevoke(ctx, &logical.Request{Storage: s, Secret: leases[1]}, nil)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	index, err = getCredsIndex(ctx, s, "service")
+	require.NoError(t, err)
+	require.Nil(t, index)
+
+	require.NotContains(t, conn.Queries(), "del_user({user});")
+
+	t.Run("Lease of an older version", func(t *testing.T) {
+		tokens["old"] = "oldtoken"
+
+		_, err := b.tokenRevoke(ctx, &logical.Request{
+			Storage: s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"token": "oldtoken",
+					"role":  roleName,
+					"user":  "service",
+				},
+			},
+		}, nil)
+		require.NoError(t, err)
+		require.Empty(t, tokens)
+	})
+
+	for name, data := range map[string]map[string]interface{}{
+		"Without creation statements": {
+			"creation_statements": "",
+		},
+		"With revocation statements": {
+			"revocation_statements": []string{"del_user({{name}});"},
+		},
+		"Without token ID": {
+			"creation_statements": []string{"new_token({{name}}, {{expiration}});"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/" + roleName,
+				Data:      data,
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+		})
+	}
+
+	t.Run("Deleted role", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, revocationModeDeleteToken, resp.Secret.InternalData["revocation_mode"])
+		require.Len(t, tokens, 1)
+
+		_, err = testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+
+		// The lease still only deletes its token
+		_, err = b.tokenRevoke(ctx, &logical.Request{Storage: s, Secret: resp.Secret}, nil)
+		require.NoError(t, err)
+		require.Empty(t, tokens)
+		require.NotContains(t, conn.Queries(), "del_user({user});")
+	})
+}
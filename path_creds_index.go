@@ -0,0 +1,79 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathCredsIndex extends the Vault API with a `/creds-index`
+// endpoint to look up the users issued by the plugin.
+func pathCredsIndex(b *thingsDBBackend) []*framework.Path {
+	// The list path goes first, as the name of a user can be anything
+	return []*framework.Path{
+		{
+			Pattern: "creds-index/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathCredsIndexList,
+				},
+			},
+			HelpSynopsis:    pathCredsIndexListHelpSynopsis,
+			HelpDescription: pathCredsIndexListHelpDescription,
+		},
+		{
+			Pattern: "creds-index/" + framework.MatchAllRegex("user"),
+			Fields: map[string]*framework.FieldSchema{
+				"user": {
+					Type:        framework.TypeString,
+					Description: "Name of the ThingsDB user",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathCredsIndexRead,
+				},
+			},
+			HelpSynopsis:    pathCredsIndexHelpSynopsis,
+			HelpDescription: pathCredsIndexHelpDescription,
+		},
+	}
+}
+
+func (b *thingsDBBackend) pathCredsIndexRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := getCredsIndex(ctx, req.Storage, d.Get("user").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: entry.toResponseData(),
+	}, nil
+}
+
+func (b *thingsDBBackend) pathCredsIndexList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, credsIndexStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+const (
+	pathCredsIndexHelpSynopsis    = `Read the record of a user issued by the plugin.`
+	pathCredsIndexHelpDescription = `
+This path returns the role, creation time, expiration and
+requester of a ThingsDB user created for dynamic credentials.
+The record is removed when the lease is revoked.
+`
+
+	pathCredsIndexListHelpSynopsis    = `List the users issued by the plugin.`
+	pathCredsIndexListHelpDescription = `Users will be listed by their ThingsDB name.`
+)
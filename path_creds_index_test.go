@@ -0,0 +1,145 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCredsIndex checks that issued users are tracked
+// until their lease is revoked.
+func TestCredsIndex(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	useFakeConns(b, newFakeCredsConn())
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target":            target,
+		"mask":              mask,
+		"max_ttl":           testMaxTTL,
+		"username_template": "app-{{.DisplayName}}.{{random 8}}",
+	})
+	require.NoError(t, err)
+
+	creds, err := b.HandleRequest(ctx, &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "creds/" + roleName,
+		Storage:     s,
+		DisplayName: "token-ci",
+		EntityID:    "entity1",
+	})
+	require.NoError(t, err)
+	user := creds.Data["user"].(string)
+
+	t.Run("List users", func(t *testing.T) {
+		resp, err := testCredsIndexList(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, []string{user}, resp.Data["keys"])
+	})
+
+	t.Run("Read user", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds-index/" + user,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, user, resp.Data["user"])
+		require.Equal(t, roleName, resp.Data["role"])
+		require.Equal(t, "token-ci", resp.Data["display_name"])
+		require.Equal(t, "entity1", resp.Data["entity_id"])
+
+		createdAt, err := time.Parse(time.RFC3339, resp.Data["created_at"].(string))
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), createdAt, 5*time.Second)
+
+		expiration, err := time.Parse(time.RFC3339, resp.Data["expiration"].(string))
+		require.NoError(t, err)
+		require.WithinDuration(t, createdAt.Add(time.Duration(testMaxTTL)*time.Second), expiration, 5*time.Second)
+	})
+
+	t.Run("Revoke removes user", func(t *testing.T) {
+		_, err := b.tokenRevoke(ctx, &logical.Request{
+			Storage: s,
+			Secret:  creds.Secret,
+		}, nil)
+		require.NoError(t, err)
+
+		resp, err := testCredsIndexList(t, b, s)
+		require.NoError(t, err)
+		require.Empty(t, resp.Data["keys"])
+
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds-index/" + user,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+func TestCredsIndexRevokeStorageError(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	conn := newFakeCredsConn()
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target":  target,
+		"mask":    mask,
+		"max_ttl": testMaxTTL,
+	})
+	require.NoError(t, err)
+
+	creds, err := b.HandleRequest(ctx, &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "creds/" + roleName,
+		Storage:     s,
+		DisplayName: "token-ci",
+	})
+	require.NoError(t, err)
+
+	// The user is deleted from ThingsDB, so the revocation must succeed
+	// even when the record can not be removed from the index
+	_, err = b.tokenRevoke(ctx, &logical.Request{
+		Storage: &failingIndexStorage{Storage: s},
+		Secret:  creds.Secret,
+	}, nil)
+	require.NoError(t, err)
+	require.Contains(t, conn.Queries(), "del_user({user});")
+}
+
+// failingIndexStorage fails to change the records of the credentials index.
+type failingIndexStorage struct {
+	logical.Storage
+}
+
+func (s *failingIndexStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, credsIndexStoragePrefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func (s *failingIndexStorage) Delete(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, credsIndexStoragePrefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+// Utility function to list the issued users and return any errors
+func testCredsIndexList(t *testing.T, b *thingsDBBackend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "creds-index/",
+		Storage:   s,
+	})
+}
@@ -83,6 +83,110 @@ func TestUserRole(t *testing.T) {
 		require.Equal(t, resp.Data["mask"], mask)
 	})
 
+	t.Run("Update User Role Grants", func(t *testing.T) {
+		resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"grants": []interface{}{
+				map[string]interface{}{"target": "//stuff", "mask": 1},
+				"//orders=16",
+			},
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read User Role Grants", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, "", resp.Data["target"])
+		require.Equal(t, []map[string]interface{}{
+			{"target": "//stuff", "mask": "1", "mask_names": "QUERY"},
+			{"target": "//orders", "mask": "16", "mask_names": "RUN"},
+		}, resp.Data["grants"])
+	})
+
+	t.Run("Invalid User Role Grants", func(t *testing.T) {
+		for _, d := range []map[string]interface{}{
+			{"grants": []interface{}{"//stuff"}},
+			{"grants": []interface{}{map[string]interface{}{"target": "//stuff"}}},
+			{"grants": []interface{}{"//stuff=1"}, "target": target},
+			{"grants": []interface{}{"//stuff=READ"}},
+			{"target": target},
+		} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/" + roleName,
+				Data:      d,
+				Storage:   s,
+			})
+
+			require.Nil(t, err)
+			require.True(t, resp.IsError(), "expected error for %v", d)
+		}
+	})
+
+	t.Run("Update User Role Shorthand", func(t *testing.T) {
+		resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"target": target,
+			"mask": mask,
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.Equal(t, []map[string]interface{}{
+			{"target": target, "mask": mask, "mask_names": "FULL"},
+		}, resp.Data["grants"])
+	})
+
+	t.Run("Update User Role Symbolic Mask", func(t *testing.T) {
+		for _, tc := range []struct {
+			mask     interface{}
+			expected string
+			names    string
+		}{
+			{"QUERY|CHANGE|GRANT", "7", "CHANGE|GRANT"},
+			{[]interface{}{"query", "run"}, "17", "QUERY|RUN"},
+			{"QUERY,JOIN", "9", "QUERY|JOIN"},
+			{"EVENT", "2", "EVENT"},
+			{"FULL", "31", "FULL"},
+			{"31", "31", "FULL"},
+		} {
+			resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+				"target": target,
+				"mask": tc.mask,
+			})
+
+			require.Nil(t, err)
+			require.Nil(t, resp)
+
+			resp, err = testTokenRoleRead(t, b, s)
+
+			require.Nil(t, err)
+			require.Equal(t, tc.expected, resp.Data["mask"])
+			require.Equal(t, tc.names, resp.Data["mask_names"])
+		}
+	})
+
+	t.Run("Invalid User Role Mask", func(t *testing.T) {
+		for _, m := range []interface{}{"3l", "QUERY|WRITE", "32", "0", ""} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/" + roleName,
+				Data:      map[string]interface{}{"target": target, "mask": m},
+				Storage:   s,
+			})
+
+			require.Nil(t, err)
+			require.True(t, resp.IsError(), "expected error for %v", m)
+		}
+	})
+
 	t.Run("Delete User Role", func(t *testing.T) {
 		_, err := testTokenRoleDelete(t, b, s)
 
@@ -155,4 +259,215 @@ func testTokenRoleDelete(t *testing.T, b *thingsDBBackend, s logical.Storage) (*
 		Path:      "role/" + roleName,
 		Storage:   s,
 	})
-}
\ No newline at end of file
+}
+
+// TestParseScope checks the supported ThingsDB scope notations.
+func TestParseScope(t *testing.T) {
+	for scope, expected := range map[string]*thingsDBScope{
+		"@thingsdb":         {Kind: scopeThingsDB},
+		"/t":                {Kind: scopeThingsDB},
+		"@node":             {Kind: scopeNode},
+		"@n:2":              {Kind: scopeNode},
+		"/node/2":           {Kind: scopeNode},
+		"//stuff":           {Kind: scopeCollection, Collection: "stuff"},
+		"@:stuff":           {Kind: scopeCollection, Collection: "stuff"},
+		"@collection:stuff": {Kind: scopeCollection, Collection: "stuff"},
+		"/c/stuff":          {Kind: scopeCollection, Collection: "stuff"},
+	} {
+		actual, err := parseScope(scope)
+		require.NoError(t, err, scope)
+		require.Equal(t, expected, actual, scope)
+	}
+
+	for _, scope := range []string{"stuff", "//", "@foo:bar", "@thingsdb:x", ""} {
+		_, err := parseScope(scope)
+		require.Error(t, err, scope)
+	}
+}
+
+// TestUserRoleTargetValidation checks that role targets are
+// verified against the collections in ThingsDB.
+func TestUserRoleTargetValidation(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		var exists []interface{}
+		for _, name := range vars["collections"].([]interface{}) {
+			exists = append(exists, name == "stuff")
+		}
+		return exists, nil
+	}
+	useFakeConns(b, conn)
+
+	t.Run("No validation", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": "//stufff",
+			"mask": mask,
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Empty(t, conn.Queries())
+	})
+
+	t.Run("Warn on missing collection", func(t *testing.T) {
+		resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"grants": []interface{}{"@thingsdb=QUERY", "//stuff=QUERY", "//stufff=QUERY"},
+			"target_validation": "warn",
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Len(t, resp.Warnings, 1)
+		require.Contains(t, resp.Warnings[0], "//stufff")
+		require.Equal(t, []interface{}{"stuff", "stufff"}, conn.Vars()[0]["collections"])
+	})
+
+	t.Run("Reject missing collection", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/" + roleName,
+			Data:      map[string]interface{}{"target_validation": "error"},
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, "warn", resp.Data["target_validation"])
+	})
+
+	t.Run("Accept existing collection", func(t *testing.T) {
+		resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"target": "//stuff",
+			"mask": mask,
+			"target_validation": "error",
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Verify endpoint", func(t *testing.T) {
+		resp, err := testTokenRoleVerify(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, true, resp.Data["valid"])
+
+		_, err = testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"target": "//stufff",
+			"target_validation": "none",
+		})
+		require.NoError(t, err)
+
+		resp, err = testTokenRoleVerify(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, false, resp.Data["valid"])
+		require.Equal(t, []string{"//stufff"}, resp.Data["missing_targets"])
+	})
+
+	t.Run("Invalid validation mode", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/" + roleName,
+			Data:      map[string]interface{}{"target_validation": "strict"},
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// Utility function to verify the targets of a role and return any errors
+func testTokenRoleVerify(t *testing.T, b *thingsDBBackend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "role/" + roleName + "/verify",
+		Storage:   s,
+	})
+}
+
+// TestUserRoleStatements checks the validation of the
+// creation and revocation statements of a role.
+func TestUserRoleStatements(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Valid statements", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask": mask,
+			"creation_statements": []string{"new_user({{name}});", "new_token({{name}}, {{expiration}});"},
+			"revocation_statements": []string{"del_user({{name}});"},
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, []string{"new_user({{name}});", "new_token({{name}}, {{expiration}});"}, resp.Data["creation_statements"])
+		require.Equal(t, []string{"del_user({{name}});"}, resp.Data["revocation_statements"])
+	})
+
+	for name, data := range map[string]map[string]interface{}{
+		"Unknown placeholder": {"creation_statements": []string{"new_user({{user}});"}},
+		"Token on creation": {"creation_statements": []string{"new_token({{token}});"}},
+		"Grants on revocation": {"revocation_statements": []string{"{{grants}};"}},
+		"Empty statement": {"revocation_statements": []string{" "}},
+		"Token without token ID": {
+			"creation_statements": []string{"new_user({{name}});", "new_token({{name}}, {{expiration}});"},
+			"revocation_statements": []string{"del_token({{token}});"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/" + roleName,
+				Data:      data,
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+		})
+	}
+}
+
+// TestUserRoleUsernameTemplate checks that username templates
+// are validated against the ThingsDB user name rules.
+func TestUserRoleUsernameTemplate(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target": target,
+		"mask": mask,
+		"username_template": "{{.RoleName}}_{{.EntityID}}",
+	})
+	require.NoError(t, err)
+
+	resp, err := testTokenRoleRead(t, b, s)
+	require.NoError(t, err)
+	require.Equal(t, "{{.RoleName}}_{{.EntityID}}", resp.Data["username_template"])
+
+	for name, tmpl := range map[string]string{
+		"Invalid syntax": "{{.RoleName",
+		"Unknown field": "{{.Foo}}",
+		"Spaces": "{{.RoleName}} {{random 8}}",
+		"Too long": "{{random 129}}",
+		"Empty result": `{{printf ""}}`,
+		"Slash": "{{.RoleName}}/{{random 8}}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "role/" + roleName,
+				Data:      map[string]interface{}{"username_template": tmpl},
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+		})
+	}
+}
@@ -3,6 +3,8 @@ package vault_plugin_secrets_thingsdb
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
@@ -13,25 +15,143 @@ import (
 // for a Vault role to access and call the ThingsDB
 // token/use creation functions.
 type thingsDBRoleEntry struct {
-	Name   string        `json:"name"`
-	Target string        `json:"target"`
-	Mask   string        `json:"mask"`
-	TTL    time.Duration `json:"ttl"`
-	MaxTTL time.Duration `json:"max_ttl"`
+	Name   string          `json:"name"`
+	Target string          `json:"target"`
+	Mask   string          `json:"mask"`
+	Grants []thingsDBGrant `json:"grants"`
+	TTL    time.Duration   `json:"ttl"`
+	MaxTTL time.Duration   `json:"max_ttl"`
+
+	TargetValidation string `json:"target_validation"`
+
+	UsernameTemplate string `json:"username_template"`
+
+	CreationStatements   []string `json:"creation_statements"`
+	RevocationStatements []string `json:"revocation_statements"`
+	RevocationMode       string   `json:"revocation_mode"`
+}
+
+// Modes for revoking the credentials of a role.
+const (
+	revocationModeDeleteUser  = "delete_user"
+	revocationModeDeleteToken = "delete_token"
+)
+
+// Modes for validating the targets of a role against ThingsDB.
+const (
+	targetValidationNone  = "none"
+	targetValidationWarn  = "warn"
+	targetValidationError = "error"
+)
+
+// thingsDBGrant defines the privileges granted
+// to a user on a single ThingsDB scope.
+type thingsDBGrant struct {
+	Target string `json:"target"`
+	Mask   string `json:"mask"`
+}
+
+// grants returns the grants of the role. The target and
+// mask of a role are a shorthand for a single grant.
+func (r *thingsDBRoleEntry) grants() []thingsDBGrant {
+	if len(r.Grants) > 0 {
+		return r.Grants
+	}
+	return []thingsDBGrant{{Target: r.Target, Mask: r.Mask}}
 }
 
 // toResponseData returns reponse data for a role
 func (r *thingsDBRoleEntry) toResponseData() map[string]interface{} {
+	grants := []map[string]interface{}{}
+	for _, grant := range r.grants() {
+		grants = append(grants, map[string]interface{}{
+			"target":     grant.Target,
+			"mask":       grant.Mask,
+			"mask_names": symbolicMask(grant.Mask),
+		})
+	}
+
 	respData := map[string]interface{}{
-		"name":    r.Name,
-		"target":  r.Target,
-		"mask":    r.Mask,
-		"ttl":     r.TTL.Seconds(),
-		"max_ttl": r.MaxTTL.Seconds(),
+		"name":              r.Name,
+		"target":            r.Target,
+		"mask":              r.Mask,
+		"mask_names":        symbolicMask(r.Mask),
+		"grants":            grants,
+		"ttl":               r.TTL.Seconds(),
+		"max_ttl":           r.MaxTTL.Seconds(),
+		"target_validation": r.targetValidation(),
+		"username_template": r.UsernameTemplate,
+
+		"creation_statements":   r.CreationStatements,
+		"revocation_statements": r.RevocationStatements,
+		"revocation_mode":       r.revocationMode(),
 	}
 	return respData
 }
 
+// targetValidation returns how the targets of the role are validated.
+func (r *thingsDBRoleEntry) targetValidation() string {
+	if r.TargetValidation == "" {
+		return targetValidationNone
+	}
+	return r.TargetValidation
+}
+
+// revocationMode returns how the credentials of the role are revoked.
+func (r *thingsDBRoleEntry) revocationMode() string {
+	if r.RevocationMode == "" {
+		return revocationModeDeleteUser
+	}
+	return r.RevocationMode
+}
+
+// parseGrants parses the grants of a role. Each grant is either
+// an object with a target and mask, or a "<target>=<mask>" string.
+// The masks are validated and normalised to their numeric form.
+func parseGrants(raw []interface{}) ([]thingsDBGrant, error) {
+	grants := make([]thingsDBGrant, 0, len(raw))
+	for _, item := range raw {
+		var target string
+		var mask []string
+		switch v := item.(type) {
+		case map[string]interface{}:
+			target, _ = v["target"].(string)
+			switch m := v["mask"].(type) {
+			case nil:
+			case []interface{}:
+				for _, name := range m {
+					mask = append(mask, fmt.Sprint(name))
+				}
+			default:
+				mask = []string{fmt.Sprint(m)}
+			}
+		case string:
+			idx := strings.LastIndex(v, "=")
+			if idx < 0 {
+				return nil, fmt.Errorf("invalid grant %q, expected <target>=<mask>", v)
+			}
+			target, mask = v[:idx], []string{v[idx+1:]}
+		default:
+			return nil, fmt.Errorf("invalid grant %v, expected an object with target and mask", item)
+		}
+
+		if target == "" || len(mask) == 0 {
+			return nil, fmt.Errorf("invalid grant %v, both target and mask are required", item)
+		}
+
+		maskInt, err := parseMask(mask)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grant %v: %w", item, err)
+		}
+
+		grants = append(grants, thingsDBGrant{
+			Target: target,
+			Mask:   strconv.Itoa(maskInt),
+		})
+	}
+	return grants, nil
+}
+
 // pathRole extends the Vault API with a `/role` endpoint for this backend.
 func pathRole(b *thingsDBBackend) []*framework.Path {
 	return []*framework.Path{
@@ -45,13 +165,15 @@ func pathRole(b *thingsDBBackend) []*framework.Path {
 				},
 				"target": {
 					Type:        framework.TypeString,
-					Description: "The target scope for ThingsDB",
-					Required:    true,
+					Description: "The target scope for ThingsDB, shorthand for a single grant",
 				},
 				"mask": {
-					Type:        framework.TypeString,
-					Description: "Bit-mask for setting privileges",
-					Required:    true,
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Privileges to grant, as a bit-mask or as names like QUERY|CHANGE|GRANT or a list of names. Shorthand for a single grant",
+				},
+				"grants": {
+					Type:        framework.TypeSlice,
+					Description: "List of grants, applied in order. Each grant is an object with a target and mask, or a <target>=<mask> string. Masks accept the same forms as mask",
 				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
@@ -61,6 +183,30 @@ func pathRole(b *thingsDBBackend) []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: "Maximum time for role. If not set or set to 0, will use system default.",
 				},
+				"target_validation": {
+					Type:          framework.TypeString,
+					Description:   "Validate the targets against ThingsDB when writing the role. Missing collections are ignored with 'none', returned as warnings with 'warn' and rejected with 'error'.",
+					Default:       targetValidationNone,
+					AllowedValues: []interface{}{targetValidationNone, targetValidationWarn, targetValidationError},
+				},
+				"username_template": {
+					Type:        framework.TypeString,
+					Description: "Template for the names of the generated users, using .RoleName, .DisplayName and .EntityID and Vault's template functions like random, truncate and unix_time",
+				},
+				"creation_statements": {
+					Type:        framework.TypeStringSlice,
+					Description: "ThingsDB code run to create the user, replacing the default provisioning. Supports {{name}}, {{expiration}}, {{grants}} and {{token_id}}, and must return the new token",
+				},
+				"revocation_statements": {
+					Type:        framework.TypeStringSlice,
+					Description: "ThingsDB code run to revoke the user, replacing the default del_user. Supports {{name}}, {{token}}, {{token_id}} and {{expiration}}",
+				},
+				"revocation_mode": {
+					Type:          framework.TypeString,
+					Description:   "Revoke credentials by deleting the user with 'delete_user', or by only deleting the token of the lease with 'delete_token', which keeps users shared by multiple leases.",
+					Default:       revocationModeDeleteUser,
+					AllowedValues: []interface{}{revocationModeDeleteUser, revocationModeDeleteToken},
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.ReadOperation: &framework.PathOperation{
@@ -80,6 +226,23 @@ func pathRole(b *thingsDBBackend) []*framework.Path {
 			HelpSynopsis:    pathRoleHelpSynopsis,
 			HelpDescription: pathRoleHelpDescription,
 		},
+		{
+			Pattern: "role/" + framework.GenericNameRegex("name") + "/verify",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRoleVerify,
+				},
+			},
+			HelpSynopsis:    pathRoleVerifyHelpSynopsis,
+			HelpDescription: pathRoleVerifyHelpDescription,
+		},
 		{
 			Pattern: "role/?$",
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -170,18 +333,54 @@ func (b *thingsDBBackend) pathRolesWrite(ctx context.Context, req *logical.Reque
 		roleEntry = &thingsDBRoleEntry{}
 	}
 
-	createOperation := req.Operation == logical.CreateOperation
+	roleEntry.Name = name.(string)
 
-	if mask, ok := d.GetOk("mask"); ok {
-		roleEntry.Mask = mask.(string)
-	} else if createOperation {
-		return nil, fmt.Errorf("missing mask in role")
-	}
+	createOperation := req.Operation == logical.CreateOperation
 
-	if target, ok := d.GetOk("target"); ok {
-		roleEntry.Target = target.(string)
-	} else if createOperation {
-		return nil, fmt.Errorf("missing target in role")
+	mask, maskOk := d.GetOk("mask")
+	target, targetOk := d.GetOk("target")
+
+	if grantsRaw, ok := d.GetOk("grants"); ok {
+		if maskOk || targetOk {
+			return logical.ErrorResponse("target and mask cannot be combined with grants"), nil
+		}
+
+		grants, err := parseGrants(grantsRaw.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		if len(grants) == 0 {
+			return logical.ErrorResponse("grants cannot be empty"), nil
+		}
+
+		roleEntry.Grants = grants
+		roleEntry.Target = ""
+		roleEntry.Mask = ""
+	} else {
+		if maskOk || targetOk {
+			roleEntry.Grants = nil
+		}
+
+		if maskOk {
+			maskInt, err := parseMask(mask.([]string))
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			roleEntry.Mask = strconv.Itoa(maskInt)
+		} else if createOperation {
+			return nil, fmt.Errorf("missing mask in role")
+		}
+
+		if targetOk {
+			roleEntry.Target = target.(string)
+		} else if createOperation {
+			return nil, fmt.Errorf("missing target in role")
+		}
+
+		if len(roleEntry.Grants) == 0 && (roleEntry.Target == "" || roleEntry.Mask == "") {
+			return logical.ErrorResponse("both target and mask are required when grants are not set"), nil
+		}
 	}
 
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
@@ -200,13 +399,205 @@ func (b *thingsDBBackend) pathRolesWrite(ctx context.Context, req *logical.Reque
 		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
 	}
 
+	if usernameTemplate, ok := d.GetOk("username_template"); ok {
+		roleEntry.UsernameTemplate = usernameTemplate.(string)
+	}
+
+	// Generate a sample name to reject templates which cannot
+	// produce a valid ThingsDB user name
+	metadata := sampleUsernameMetadata
+	metadata.RoleName = roleEntry.Name
+	if _, err := renderUsername(roleEntry.usernameTemplate(), metadata); err != nil {
+		return logical.ErrorResponse("invalid username_template: %s", err), nil
+	}
+
+	if statements, ok := d.GetOk("creation_statements"); ok {
+		roleEntry.CreationStatements = statements.([]string)
+	}
+
+	if err := validateStatements(roleEntry.CreationStatements, placeholderName, placeholderExpiration, placeholderGrants, placeholderTokenID); err != nil {
+		return logical.ErrorResponse("invalid creation_statements: %s", err), nil
+	}
+
+	if statements, ok := d.GetOk("revocation_statements"); ok {
+		roleEntry.RevocationStatements = statements.([]string)
+	}
+
+	if err := validateStatements(roleEntry.RevocationStatements, placeholderName, placeholderToken, placeholderTokenID, placeholderExpiration); err != nil {
+		return logical.ErrorResponse("invalid revocation_statements: %s", err), nil
+	}
+
+	if mode, ok := d.GetOk("revocation_mode"); ok {
+		roleEntry.RevocationMode = mode.(string)
+	}
+
+	switch roleEntry.revocationMode() {
+	case revocationModeDeleteUser:
+	case revocationModeDeleteToken:
+		if len(roleEntry.RevocationStatements) > 0 {
+			return logical.ErrorResponse("revocation_mode %q cannot be combined with revocation_statements", revocationModeDeleteToken), nil
+		}
+
+		// The default provisioning creates a new user for every lease,
+		// which would be left behind when only the token is deleted
+		if len(roleEntry.CreationStatements) == 0 {
+			return logical.ErrorResponse("revocation_mode %q requires creation_statements", revocationModeDeleteToken), nil
+		}
+	default:
+		return logical.ErrorResponse("revocation_mode must be %q or %q", revocationModeDeleteUser, revocationModeDeleteToken), nil
+	}
+
+	// The token is found in ThingsDB by its description, so the creation
+	// statements must set the token ID when revocation needs the token
+	needsTokenID := roleEntry.revocationMode() == revocationModeDeleteToken || usesPlaceholder(roleEntry.RevocationStatements, placeholderToken) || usesPlaceholder(roleEntry.RevocationStatements, placeholderTokenID)
+	if len(roleEntry.CreationStatements) > 0 && needsTokenID && !usesPlaceholder(roleEntry.CreationStatements, placeholderTokenID) {
+		return logical.ErrorResponse("creation_statements must pass {{%s}} as the description of the new token to revoke a single token", placeholderTokenID), nil
+	}
+
+	if validation, ok := d.GetOk("target_validation"); ok {
+		roleEntry.TargetValidation = validation.(string)
+	}
+
+	switch roleEntry.targetValidation() {
+	case targetValidationNone, targetValidationWarn, targetValidationError:
+	default:
+		return logical.ErrorResponse("target_validation must be one of %q, %q or %q", targetValidationNone, targetValidationWarn, targetValidationError), nil
+	}
+
+	var warnings []string
+	if roleEntry.targetValidation() != targetValidationNone {
+		missing, err := b.missingTargets(ctx, req.Storage, roleEntry)
+		if err != nil {
+			if roleEntry.targetValidation() == targetValidationError {
+				return logical.ErrorResponse("error verifying targets: %s", err), nil
+			}
+			warnings = append(warnings, fmt.Sprintf("could not verify targets: %s", err))
+		} else if len(missing) > 0 {
+			msg := fmt.Sprintf("collections of targets %s do not exist in ThingsDB", strings.Join(missing, ", "))
+			if roleEntry.targetValidation() == targetValidationError {
+				return logical.ErrorResponse(msg), nil
+			}
+			warnings = append(warnings, msg)
+		}
+	}
+
 	if err := setRole(ctx, req.Storage, name.(string), roleEntry); err != nil {
 		return nil, err
 	}
 
+	if len(warnings) > 0 {
+		resp := &logical.Response{}
+		for _, warning := range warnings {
+			resp.AddWarning(warning)
+		}
+		return resp, nil
+	}
+
 	return nil, nil
 }
 
+// missingTargets returns the targets of the role for which the
+// collection does not exist in ThingsDB.
+func (b *thingsDBBackend) missingTargets(ctx context.Context, s logical.Storage, roleEntry *thingsDBRoleEntry) ([]string, error) {
+	var targets []string
+	var collections []interface{}
+	for _, grant := range roleEntry.grants() {
+		scope, err := parseScope(grant.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		if scope.Kind == scopeCollection {
+			targets = append(targets, grant.Target)
+			collections = append(collections, scope.Collection)
+		}
+	}
+
+	if len(collections) == 0 {
+		return nil, nil
+	}
+
+	var missing []string
+	err := b.withClient(ctx, s, func(client *thingsDBClient) error {
+		exists, err := collectionsExist(client, collections)
+		if err != nil {
+			return err
+		}
+
+		missing = nil
+		for i, target := range targets {
+			if !exists[i] {
+				missing = append(missing, target)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// collectionsExist checks for each collection if it exists in ThingsDB.
+func collectionsExist(c *thingsDBClient, collections []interface{}) ([]bool, error) {
+	vars := map[string]interface{}{
+		"collections": collections,
+	}
+
+	resp, err := c.Query("@thingsdb", "collections.map(|name| has_collection(name));", vars)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := resp.([]interface{})
+	if !ok || len(list) != len(collections) {
+		return nil, fmt.Errorf("unexpected has_collection response: %v", resp)
+	}
+
+	exists := make([]bool, len(list))
+	for i, item := range list {
+		if exists[i], ok = item.(bool); !ok {
+			return nil, fmt.Errorf("unexpected has_collection response: %v", resp)
+		}
+	}
+
+	return exists, nil
+}
+
+func (b *thingsDBBackend) pathRoleVerify(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleEntry, err := b.getRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if roleEntry == nil {
+		return nil, nil
+	}
+
+	missing, err := b.missingTargets(ctx, req.Storage, roleEntry)
+	if err != nil {
+		return logical.ErrorResponse("error verifying targets: %s", err), nil
+	}
+
+	if len(missing) > 0 && roleEntry.targetValidation() == targetValidationError {
+		return logical.ErrorResponse("collections of targets %s do not exist in ThingsDB", strings.Join(missing, ", ")), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"valid":           len(missing) == 0,
+			"missing_targets": missing,
+		},
+	}
+
+	if len(missing) > 0 {
+		resp.AddWarning(fmt.Sprintf("collections of targets %s do not exist in ThingsDB", strings.Join(missing, ", ")))
+	}
+
+	return resp, nil
+}
+
 func (b *thingsDBBackend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	err := req.Storage.Delete(ctx, "role/"+d.Get("name").(string))
 	if err != nil {
@@ -229,6 +620,12 @@ const (
 	pathRoleHelpSynopsis    = `Manages the Vault role for generating Fortigate admins.`
 	pathRoleHelpDescription = `
 This path allows you to read and write roles used to generate Fortigate admins.
+`
+
+	pathRoleVerifyHelpSynopsis    = `Verify the targets of a role against ThingsDB.`
+	pathRoleVerifyHelpDescription = `
+This path checks that the collections targeted by the grants
+of the role exist in ThingsDB.
 `
 
 	pathRoleListHelpSynopsis    = `List the existing roles in Fortigate backend`
@@ -0,0 +1,201 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// deleteStaticTokensQuery deletes all tokens of a static user,
+// except for the tokens which are still handed out by Vault.
+const deleteStaticTokensQuery = `
+user_info(user).load().tokens.filter(|t| !keep.has(t.key)).each(|t| del_token(t.key));
+`
+
+// pathRotateRole extends the Vault API with a `/rotate-role`
+// endpoint to rotate the token of a static role.
+func pathRotateRole(b *thingsDBBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "rotate-role/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the static role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathRotateRoleUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathRotateRoleHelpSynopsis,
+		HelpDescription: pathRotateRoleHelpDescription,
+	}
+}
+
+func (b *thingsDBBackend) pathRotateRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.staticLock.Lock()
+	defer b.staticLock.Unlock()
+
+	roleEntry, err := getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if roleEntry == nil {
+		return logical.ErrorResponse("unknown static role"), nil
+	}
+
+	if err := b.rotateStaticRole(ctx, req.Storage, roleEntry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// rotateStaticRole creates a new token for the user of a static role and
+// deletes all other tokens of the user, except for the previous tokens
+// within their overlap period. The caller must hold the static lock.
+func (b *thingsDBBackend) rotateStaticRole(ctx context.Context, s logical.Storage, roleEntry *thingsDBStaticRoleEntry) error {
+	now := time.Now()
+
+	var token string
+	err := b.withClient(ctx, s, func(client *thingsDBClient) error {
+		var err error
+		token, err = createStaticToken(client, roleEntry.Username)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating token for user %q: %w", roleEntry.Username, err)
+	}
+
+	if roleEntry.Token != "" && roleEntry.OverlapPeriod > 0 {
+		roleEntry.PreviousTokens = append(roleEntry.PreviousTokens, previousToken{
+			Token:     roleEntry.Token,
+			ExpiresAt: now.Add(roleEntry.OverlapPeriod),
+		})
+	}
+
+	roleEntry.Token = token
+	roleEntry.LastVaultRotation = now
+
+	// Store the new token before deleting the old ones, so a token
+	// known to ThingsDB is never lost when storage fails
+	if err := setStaticRole(ctx, s, roleEntry); err != nil {
+		return fmt.Errorf("error storing token for user %q: %w", roleEntry.Username, err)
+	}
+
+	return b.pruneStaticTokens(ctx, s, roleEntry, now)
+}
+
+// pruneStaticTokens deletes the tokens of a static user which are
+// no longer handed out by Vault. The caller must hold the static lock.
+func (b *thingsDBBackend) pruneStaticTokens(ctx context.Context, s logical.Storage, roleEntry *thingsDBStaticRoleEntry, now time.Time) error {
+	keep := []interface{}{roleEntry.Token}
+	var previous []previousToken
+	for _, prev := range roleEntry.PreviousTokens {
+		if now.Before(prev.ExpiresAt) {
+			keep = append(keep, prev.Token)
+			previous = append(previous, prev)
+		}
+	}
+
+	err := b.withClient(ctx, s, func(client *thingsDBClient) error {
+		_, err := client.Query("@thingsdb", deleteStaticTokensQuery, map[string]interface{}{
+			"user": roleEntry.Username,
+			"keep": keep,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting previous tokens of user %q: %w", roleEntry.Username, err)
+	}
+
+	if len(previous) == len(roleEntry.PreviousTokens) {
+		return nil
+	}
+
+	roleEntry.PreviousTokens = previous
+	return setStaticRole(ctx, s, roleEntry)
+}
+
+// rotateStaticRolesIfDue rotates the tokens of the static roles of which
+// the rotation period has passed, and deletes previous tokens of which
+// the overlap period has passed.
+func (b *thingsDBBackend) rotateStaticRolesIfDue(ctx context.Context, s logical.Storage) error {
+	names, err := s.List(ctx, "static-role/")
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range names {
+		if err := b.rotateStaticRoleIfDue(ctx, s, name); err != nil {
+			b.Logger().Error("error rotating static role", "role", name, "error", err)
+			errs = append(errs, fmt.Errorf("static role %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *thingsDBBackend) rotateStaticRoleIfDue(ctx context.Context, s logical.Storage, name string) error {
+	b.staticLock.Lock()
+	defer b.staticLock.Unlock()
+
+	roleEntry, err := getStaticRole(ctx, s, name)
+	if err != nil || roleEntry == nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if next := roleEntry.nextRotation(); !next.IsZero() && !now.Before(next) {
+		b.Logger().Info("rotating token of static role", "role", name, "last_vault_rotation", roleEntry.LastVaultRotation)
+		return b.rotateStaticRole(ctx, s, roleEntry)
+	}
+
+	for _, prev := range roleEntry.PreviousTokens {
+		if !now.Before(prev.ExpiresAt) {
+			return b.pruneStaticTokens(ctx, s, roleEntry, now)
+		}
+	}
+
+	return nil
+}
+
+// createStaticToken creates a new token for the user of a static role.
+func createStaticToken(c *thingsDBClient, user string) (string, error) {
+	vars := map[string]interface{}{
+		"user": user,
+	}
+
+	resp, err := c.Query("@thingsdb", "new_token({user});", vars)
+	if err != nil {
+		return "", err
+	}
+
+	token, ok := resp.(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("unexpected new_token response: %v", resp)
+	}
+
+	return token, nil
+}
+
+const pathRotateRoleHelpSynopsis = `
+Rotate the token of a static role
+`
+
+const pathRotateRoleHelpDescription = `
+This path creates a new token for the user of a static role. The
+previous token keeps working for the overlap period of the role,
+after which it is deleted from ThingsDB.
+`
@@ -0,0 +1,290 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTokenServer keeps track of the tokens of the static user.
+type fakeTokenServer struct {
+	mu     sync.Mutex
+	count  int
+	tokens []string
+}
+
+// Tokens returns the tokens of the static user in ThingsDB.
+func (f *fakeTokenServer) Tokens() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.tokens...)
+}
+
+// newFakeTokenServer returns a fake connection which creates and
+// deletes tokens of the static user, which starts out with a token
+// that was not created by Vault.
+func newFakeTokenServer() (*fakeTokenServer, *fakeConn) {
+	server := &fakeTokenServer{tokens: []string{"token_0"}}
+
+	conn := newFakeStaticConn()
+	queryFunc := conn.QueryFunc
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(code, "new_token("):
+			server.count++
+			token := fmt.Sprintf("token_%d", server.count)
+			server.tokens = append(server.tokens, token)
+			return token, nil
+		case code == deleteStaticTokensQuery:
+			var tokens []string
+			for _, token := range server.tokens {
+				for _, keep := range vars["keep"].([]interface{}) {
+					if token == keep {
+						tokens = append(tokens, token)
+					}
+				}
+			}
+			server.tokens = tokens
+			return nil, nil
+		}
+		return queryFunc(scope, code, vars)
+	}
+	return server, conn
+}
+
+// TestRotateRole checks the manual and periodic rotation
+// of the tokens of static roles.
+func TestRotateRole(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Rotate without overlap", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		server, conn := newFakeTokenServer()
+		useFakeConns(b, conn)
+
+		_, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username": staticUser,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"token_1"}, server.Tokens())
+
+		resp, err := testRotateRole(t, b, s, staticRoleName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Equal(t, []string{"token_2"}, server.Tokens())
+
+		resp, err = testStaticCredsRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, "token_2", resp.Data["token"])
+		require.NotContains(t, resp.Data, "ttl")
+	})
+
+	t.Run("Rotate with overlap", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		server, conn := newFakeTokenServer()
+		useFakeConns(b, conn)
+
+		_, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username":        staticUser,
+			"rotation_period": "24h",
+			"overlap_period":  "1h",
+		})
+		require.NoError(t, err)
+
+		_, err = testRotateRole(t, b, s, staticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"token_1", "token_2"}, server.Tokens())
+
+		resp, err := testStaticCredsRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, "token_2", resp.Data["token"])
+		require.InDelta(t, 24*time.Hour.Seconds(), resp.Data["ttl"], 5)
+
+		// Nothing is due yet
+		require.NoError(t, b.rotateStaticRolesIfDue(ctx, s))
+		require.Equal(t, []string{"token_1", "token_2"}, server.Tokens())
+
+		// Previous tokens are deleted once the overlap period passed
+		role, err := getStaticRole(ctx, s, staticRoleName)
+		require.NoError(t, err)
+		role.PreviousTokens[0].ExpiresAt = time.Now().Add(-time.Minute)
+		require.NoError(t, setStaticRole(ctx, s, role))
+
+		require.NoError(t, b.rotateStaticRolesIfDue(ctx, s))
+		require.Equal(t, []string{"token_2"}, server.Tokens())
+
+		role, err = getStaticRole(ctx, s, staticRoleName)
+		require.NoError(t, err)
+		require.Empty(t, role.PreviousTokens)
+		require.Equal(t, "token_2", role.Token)
+	})
+
+	t.Run("Periodic rotation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		server, conn := newFakeTokenServer()
+		useFakeConns(b, conn)
+
+		_, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username":        staticUser,
+			"rotation_period": "24h",
+			"overlap_period":  "1h",
+		})
+		require.NoError(t, err)
+
+		role, err := getStaticRole(ctx, s, staticRoleName)
+		require.NoError(t, err)
+		role.LastVaultRotation = time.Now().Add(-25 * time.Hour)
+		require.NoError(t, setStaticRole(ctx, s, role))
+
+		resp, err := testStaticCredsRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), resp.Data["ttl"])
+
+		require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+		require.Equal(t, []string{"token_1", "token_2"}, server.Tokens())
+
+		resp, err = testStaticCredsRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, "token_2", resp.Data["token"])
+		require.InDelta(t, 24*time.Hour.Seconds(), resp.Data["ttl"], 5)
+	})
+
+	t.Run("Periodic rotation with a failing root rotation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		server, conn := newFakeTokenServer()
+		queryFunc := conn.QueryFunc
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			if code == "new_token(user_info().load().name);" {
+				return nil, errors.New("query failed")
+			}
+			return queryFunc(scope, code, vars)
+		}
+		useFakeConns(b, conn)
+
+		err := testConfigCreate(t, b, s, map[string]interface{}{
+			"hostname":             hostname,
+			"port":                 port,
+			"insecure":             insecure,
+			"token":                token,
+			"root_rotation_period": "720h",
+			"verify_connection":    false,
+		})
+		require.NoError(t, err)
+
+		_, err = testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username":        staticUser,
+			"rotation_period": "24h",
+		})
+		require.NoError(t, err)
+
+		role, err := getStaticRole(ctx, s, staticRoleName)
+		require.NoError(t, err)
+		role.LastVaultRotation = time.Now().Add(-25 * time.Hour)
+		require.NoError(t, setStaticRole(ctx, s, role))
+
+		err = b.periodicFunc(ctx, &logical.Request{Storage: s})
+		require.ErrorContains(t, err, "error rotating root token")
+		require.Equal(t, []string{"token_2"}, server.Tokens())
+	})
+
+	t.Run("Delete during rotation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		_, conn := newFakeTokenServer()
+		useFakeConns(b, conn)
+
+		_, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username": staticUser,
+		})
+		require.NoError(t, err)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		queryFunc := conn.QueryFunc
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			if strings.HasPrefix(code, "new_token(") {
+				close(started)
+				<-release
+			}
+			return queryFunc(scope, code, vars)
+		}
+
+		rotated := make(chan error)
+		go func() {
+			_, err := testRotateRole(t, b, s, staticRoleName)
+			rotated <- err
+		}()
+		<-started
+
+		deleted := make(chan error)
+		go func() {
+			_, err := testStaticRoleWrite(t, b, s, logical.DeleteOperation, nil)
+			deleted <- err
+		}()
+
+		// The role is deleted once the rotation finished
+		select {
+		case <-deleted:
+			t.Fatal("static role was deleted during the rotation")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+		require.NoError(t, <-rotated)
+		require.NoError(t, <-deleted)
+
+		role, err := getStaticRole(ctx, s, staticRoleName)
+		require.NoError(t, err)
+		require.Nil(t, role)
+	})
+
+	t.Run("Invalid periods", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		useFakeConns(b, newFakeStaticConn())
+
+		resp, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username":        staticUser,
+			"rotation_period": "1h",
+			"overlap_period":  "1h",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Unknown role", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		resp, err := testRotateRole(t, b, s, "missing")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// Utility function to rotate the token of a static role and return any errors
+func testRotateRole(t *testing.T, b *thingsDBBackend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-role/" + name,
+		Storage:   s,
+	})
+}
+
+// Utility function to read the token of the static role and return any errors
+func testStaticCredsRead(t *testing.T, b *thingsDBBackend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "static-creds/" + staticRoleName,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,183 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/base62"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// rootPasswordLength is the length of generated root passwords.
+const rootPasswordLength = 32
+
+// pathRotateRoot extends the Vault API with a `/rotate-root`
+// endpoint to rotate the credentials used by the backend.
+func pathRotateRoot(b *thingsDBBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "rotate-root",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathRotateRootUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathRotateRootHelpSynopsis,
+		HelpDescription: pathRotateRootHelpDescription,
+	}
+}
+
+func (b *thingsDBBackend) pathRotateRootUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := b.rotateRoot(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// rotateRoot creates a new token for the user the backend authenticates
+// as, stores it in the config and deletes the previous token.
+func (b *thingsDBBackend) rotateRoot(ctx context.Context, s logical.Storage) error {
+	b.rootLock.Lock()
+	defer b.rootLock.Unlock()
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if config == nil {
+		return errors.New("no configuration found")
+	}
+
+	if config.Token == "" {
+		return b.rotateRootPassword(ctx, s, config)
+	}
+
+	oldToken := config.Token
+
+	var newToken string
+	err = b.withClient(ctx, s, func(client *thingsDBClient) error {
+		var err error
+		newToken, err = createRootToken(client)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating root token: %w", err)
+	}
+
+	config.Token = newToken
+	config.LastRotated = time.Now().UTC()
+	if err := setConfig(ctx, s, config); err != nil {
+		return fmt.Errorf("error storing root token: %w", err)
+	}
+
+	// Reconnect so the new token is used from now on
+	b.reset()
+
+	err = b.withClient(ctx, s, func(client *thingsDBClient) error {
+		return deleteRootToken(client, oldToken)
+	})
+	if err != nil {
+		return fmt.Errorf("root token rotated, but the previous token could not be deleted: %w", err)
+	}
+
+	return nil
+}
+
+// rotateRootPassword sets a new random password for the user the
+// backend authenticates as and stores it in the config.
+func (b *thingsDBBackend) rotateRootPassword(ctx context.Context, s logical.Storage, config *thingsDBConfig) error {
+	newPassword, err := base62.Random(rootPasswordLength)
+	if err != nil {
+		return fmt.Errorf("error generating root password: %w", err)
+	}
+
+	err = b.withClient(ctx, s, func(client *thingsDBClient) error {
+		return setRootPassword(client, config.Username, newPassword)
+	})
+	if err != nil {
+		return fmt.Errorf("error setting root password: %w", err)
+	}
+
+	config.Password = newPassword
+	config.LastRotated = time.Now().UTC()
+	if err := setConfig(ctx, s, config); err != nil {
+		return fmt.Errorf("error storing root password: %w", err)
+	}
+
+	// Reconnect so the new password is used from now on
+	b.reset()
+
+	return nil
+}
+
+// rotateRootIfDue rotates the root token when the configured
+// root rotation period has passed since the last rotation.
+func (b *thingsDBBackend) rotateRootIfDue(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if config == nil || config.RootRotationPeriod <= 0 {
+		return nil
+	}
+
+	if !config.LastRotated.IsZero() && time.Since(config.LastRotated) < config.RootRotationPeriod {
+		return nil
+	}
+
+	b.Logger().Info("rotating root token", "last_rotated", config.LastRotated)
+	return b.rotateRoot(ctx, s)
+}
+
+// createRootToken creates a new token for the authenticated user.
+func createRootToken(c *thingsDBClient) (string, error) {
+	resp, err := c.Query("@thingsdb", "new_token(user_info().load().name);", nil)
+	if err != nil {
+		return "", err
+	}
+
+	token, ok := resp.(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("unexpected new_token response: %v", resp)
+	}
+
+	return token, nil
+}
+
+// setRootPassword changes the password of the given user.
+func setRootPassword(c *thingsDBClient, user string, password string) error {
+	vars := map[string]interface{}{
+		"user":     user,
+		"password": password,
+	}
+
+	_, err := c.Query("@thingsdb", "set_password({user}, {password});", vars)
+	return err
+}
+
+// deleteRootToken deletes a token of the authenticated user.
+func deleteRootToken(c *thingsDBClient, token string) error {
+	vars := map[string]interface{}{
+		"token": token,
+	}
+
+	_, err := c.Query("@thingsdb", "del_token({token});", vars)
+	return err
+}
+
+const pathRotateRootHelpSynopsis = `Rotate the ThingsDB credentials used by the backend.`
+
+const pathRotateRootHelpDescription = `
+This path creates a new token for the ThingsDB user configured
+in the backend, stores it in the config and deletes the previous
+token. When the backend authenticates with a username and password,
+a new random password is set instead. After rotating, the credentials
+are only known to Vault.
+`
@@ -0,0 +1,220 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRotateRoot uses fake connections to check that the root
+// token is replaced and the previous token is deleted.
+func TestRotateRoot(t *testing.T) {
+	t.Run("Rotate root token", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		err := testConfigCreate(t, b, s, map[string]interface{}{
+			"hostname":          hostname,
+			"port":              port,
+			"insecure":          insecure,
+			"token":             token,
+			"verify_connection": false,
+		})
+		require.NoError(t, err)
+
+		oldConn := newFakeConn()
+		oldConn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return "newroottoken", nil
+		}
+
+		var deleted interface{}
+		newConn := newFakeConn()
+		newConn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			deleted = vars["token"]
+			return nil, nil
+		}
+		useFakeConns(b, oldConn, newConn)
+
+		resp, err := testRotateRoot(t, b, s)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		config, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.Equal(t, "newroottoken", config.Token)
+
+		require.Equal(t, []string{"new_token(user_info().load().name);"}, oldConn.Queries())
+		require.Equal(t, []string{"del_token({token});"}, newConn.Queries())
+		require.Equal(t, token, deleted)
+		require.False(t, oldConn.IsConnected())
+	})
+
+	t.Run("Rotate root password", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		err := testConfigCreate(t, b, s, map[string]interface{}{
+			"hostname":          hostname,
+			"port":              port,
+			"insecure":          insecure,
+			"username":          "admin",
+			"password":          "pass",
+			"verify_connection": false,
+		})
+		require.NoError(t, err)
+
+		var vars map[string]interface{}
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, v map[string]interface{}) (interface{}, error) {
+			vars = v
+			return nil, nil
+		}
+		useFakeConns(b, conn)
+
+		resp, err := testRotateRoot(t, b, s)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		config, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.Equal(t, []string{"set_password({user}, {password});"}, conn.Queries())
+		require.Equal(t, "admin", vars["user"])
+		require.Equal(t, vars["password"], config.Password)
+		require.Len(t, config.Password, rootPasswordLength)
+		require.Empty(t, config.Token)
+	})
+
+	t.Run("Config written during rotation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		err := testConfigCreate(t, b, s, map[string]interface{}{
+			"hostname":          hostname,
+			"port":              port,
+			"insecure":          insecure,
+			"token":             token,
+			"verify_connection": false,
+		})
+		require.NoError(t, err)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		oldConn := newFakeConn()
+		oldConn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return "newroottoken", nil
+		}
+		useFakeConns(b, oldConn, newFakeConn())
+
+		rotated := make(chan error)
+		go func() {
+			_, err := testRotateRoot(t, b, s)
+			rotated <- err
+		}()
+		<-started
+
+		written := make(chan error)
+		go func() {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      configStoragePath,
+				Data:      map[string]interface{}{"token": "operatortoken", "verify_connection": false},
+				Storage:   s,
+			})
+			written <- err
+		}()
+
+		// The config is written once the rotation finished
+		select {
+		case <-written:
+			t.Fatal("config was written during the rotation")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+		require.NoError(t, <-rotated)
+		require.NoError(t, <-written)
+
+		config, err := getConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.Equal(t, "operatortoken", config.Token)
+	})
+
+	t.Run("Rotate root without config", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		_, err := testRotateRoot(t, b, s)
+		require.Error(t, err)
+	})
+}
+
+// TestRotateRootPeriodic checks that the root token is rotated
+// by the periodic function once the rotation period has passed.
+func TestRotateRootPeriodic(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	err := testConfigCreate(t, b, s, map[string]interface{}{
+		"hostname":             hostname,
+		"port":                 port,
+		"insecure":             insecure,
+		"token":                token,
+		"root_rotation_period": "720h",
+		"verify_connection":    false,
+	})
+	require.NoError(t, err)
+
+	rootConn := func() *fakeConn {
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return "newroottoken", nil
+		}
+		return conn
+	}
+	first, second := rootConn(), rootConn()
+	useFakeConns(b, first, second)
+
+	req := &logical.Request{Storage: s}
+
+	// The configured token was never rotated by Vault
+	require.NoError(t, b.periodicFunc(context.Background(), req))
+
+	config, err := getConfig(context.Background(), s)
+	require.NoError(t, err)
+	require.Equal(t, "newroottoken", config.Token)
+	require.WithinDuration(t, time.Now(), config.LastRotated, time.Minute)
+	require.Len(t, first.Queries(), 1)
+	require.Len(t, second.Queries(), 1)
+
+	// The rotation period has not passed yet
+	require.NoError(t, b.periodicFunc(context.Background(), req))
+	require.Len(t, second.Queries(), 1)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configStoragePath,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, float64(720*60*60), resp.Data["root_rotation_period"])
+	require.Equal(t, config.LastRotated.Format(time.RFC3339), resp.Data["last_rotated"])
+
+	// Rotation is due once the period has passed
+	config.LastRotated = time.Now().Add(-721 * time.Hour)
+	require.NoError(t, setConfig(context.Background(), s, config))
+	third := rootConn()
+	useFakeConns(b, third)
+	require.NoError(t, b.periodicFunc(context.Background(), req))
+	require.Len(t, second.Queries(), 2)
+	require.Len(t, third.Queries(), 1)
+}
+
+// Utility function to rotate the root token and return any errors
+func testRotateRoot(t *testing.T, b *thingsDBBackend, s logical.Storage) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate-root",
+		Storage:   s,
+	})
+}
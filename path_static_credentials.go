@@ -0,0 +1,71 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathStaticCredentials extends the Vault API with a `/static-creds`
+// endpoint for a static role.
+func pathStaticCredentials(b *thingsDBBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "static-creds/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the static role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathStaticCredentialsRead,
+			},
+		},
+		HelpSynopsis:    pathStaticCredentialsHelpSynopsis,
+		HelpDescription: pathStaticCredentialsHelpDescription,
+	}
+}
+
+func (b *thingsDBBackend) pathStaticCredentialsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleEntry, err := getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if roleEntry == nil {
+		return logical.ErrorResponse("unknown static role"), nil
+	}
+
+	data := map[string]interface{}{
+		"user":                roleEntry.Username,
+		"token":               roleEntry.Token,
+		"last_vault_rotation": roleEntry.LastVaultRotation.Format(time.RFC3339),
+		"rotation_period":     roleEntry.RotationPeriod.Seconds(),
+	}
+
+	// Tell consumers when to read the token again
+	if next := roleEntry.nextRotation(); !next.IsZero() {
+		ttl := time.Until(next)
+		if ttl < 0 {
+			ttl = 0
+		}
+		data["ttl"] = int64(ttl.Seconds())
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+const pathStaticCredentialsHelpSynopsis = `
+Read the current token of a static role
+`
+
+const pathStaticCredentialsHelpDescription = `
+This path returns the current ThingsDB token
+of the user bound to a static role.
+`
@@ -0,0 +1,324 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// thingsDBStaticRoleEntry binds a Vault role to an existing
+// ThingsDB user, of which the tokens are owned by Vault.
+type thingsDBStaticRoleEntry struct {
+	Name              string          `json:"name"`
+	Username          string          `json:"username"`
+	Token             string          `json:"token"`
+	LastVaultRotation time.Time       `json:"last_vault_rotation"`
+	RotationPeriod    time.Duration   `json:"rotation_period"`
+	OverlapPeriod     time.Duration   `json:"overlap_period"`
+	PreviousTokens    []previousToken `json:"previous_tokens"`
+}
+
+// previousToken is a replaced token of a static role, which
+// keeps working until the overlap period has passed.
+type previousToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// toResponseData returns response data for a static role
+func (r *thingsDBStaticRoleEntry) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"name":                r.Name,
+		"username":            r.Username,
+		"last_vault_rotation": r.LastVaultRotation.Format(time.RFC3339),
+		"rotation_period":     r.RotationPeriod.Seconds(),
+		"overlap_period":      r.OverlapPeriod.Seconds(),
+	}
+}
+
+// nextRotation returns when the token of the role is rotated
+// next, or a zero time if it is not rotated automatically.
+func (r *thingsDBStaticRoleEntry) nextRotation() time.Time {
+	if r.RotationPeriod <= 0 {
+		return time.Time{}
+	}
+	return r.LastVaultRotation.Add(r.RotationPeriod)
+}
+
+// pathStaticRole extends the Vault API with a `/static-role`
+// endpoint for this backend.
+func pathStaticRole(b *thingsDBBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "static-role/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the static role",
+					Required:    true,
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Name of the existing ThingsDB user to manage. Cannot be changed after the role is created",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Period after which Vault rotates the token of the user. If not set or set to 0, the token is only rotated manually",
+				},
+				"overlap_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time the previous token keeps working after a rotation. If not set or set to 0, the previous token is deleted right away",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesDelete,
+				},
+			},
+			ExistenceCheck:  b.pathRoleExistenceCheck,
+			HelpSynopsis:    pathStaticRoleHelpSynopsis,
+			HelpDescription: pathStaticRoleHelpDescription,
+		},
+		{
+			Pattern: "static-role/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesList,
+				},
+			},
+			HelpSynopsis:    pathStaticRoleListHelpSynopsis,
+			HelpDescription: pathStaticRoleListHelpDescription,
+		},
+	}
+}
+
+func getStaticRole(ctx context.Context, s logical.Storage, name string) (*thingsDBStaticRoleEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing role name")
+	}
+
+	entry, err := s.Get(ctx, "static-role/"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var role thingsDBStaticRoleEntry
+
+	if err = entry.DecodeJSON(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// staticRoleOfUser returns the name of the static role bound
+// to the user, or an empty string if there is none.
+func staticRoleOfUser(ctx context.Context, s logical.Storage, username string) (string, error) {
+	names, err := s.List(ctx, "static-role/")
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		role, err := getStaticRole(ctx, s, name)
+		if err != nil {
+			return "", err
+		}
+
+		if role != nil && role.Username == username {
+			return role.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+func setStaticRole(ctx context.Context, s logical.Storage, roleEntry *thingsDBStaticRoleEntry) error {
+	entry, err := logical.StorageEntryJSON("static-role/"+roleEntry.Name, roleEntry)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return fmt.Errorf("failed to create storage entry for static role")
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func (b *thingsDBBackend) pathStaticRolesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: entry.toResponseData(),
+	}, nil
+}
+
+func (b *thingsDBBackend) pathStaticRolesWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.staticLock.Lock()
+	defer b.staticLock.Unlock()
+
+	roleEntry, err := getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	username := d.Get("username").(string)
+
+	createOperation := roleEntry == nil
+	if createOperation {
+		if username == "" {
+			return logical.ErrorResponse("missing username in static role"), nil
+		}
+
+		// Every role deletes the tokens it does not know of when rotating,
+		// so roles sharing a user would revoke each other's token
+		owner, err := staticRoleOfUser(ctx, req.Storage, username)
+		if err != nil {
+			return nil, err
+		}
+
+		if owner != "" {
+			return logical.ErrorResponse("user %q is already managed by static role %q", username, owner), nil
+		}
+
+		roleEntry = &thingsDBStaticRoleEntry{
+			Name:     name,
+			Username: username,
+		}
+	} else if username != "" && username != roleEntry.Username {
+		return logical.ErrorResponse("username of a static role cannot be changed"), nil
+	}
+
+	if rotationPeriod, ok := d.GetOk("rotation_period"); ok {
+		roleEntry.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if overlapPeriod, ok := d.GetOk("overlap_period"); ok {
+		roleEntry.OverlapPeriod = time.Duration(overlapPeriod.(int)) * time.Second
+	}
+
+	if roleEntry.RotationPeriod < 0 || roleEntry.OverlapPeriod < 0 {
+		return logical.ErrorResponse("rotation_period and overlap_period cannot be negative"), nil
+	}
+
+	if roleEntry.RotationPeriod > 0 && roleEntry.OverlapPeriod >= roleEntry.RotationPeriod {
+		return logical.ErrorResponse("overlap_period must be shorter than rotation_period"), nil
+	}
+
+	if !createOperation {
+		return nil, setStaticRole(ctx, req.Storage, roleEntry)
+	}
+
+	var respErr string
+	err = b.withClient(ctx, req.Storage, func(client *thingsDBClient) error {
+		exists, err := userExists(client, username)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			respErr = fmt.Sprintf("user %q does not exist in ThingsDB", username)
+			return nil
+		}
+
+		current, err := currentUser(client)
+		if err != nil {
+			return err
+		}
+
+		if current == username {
+			respErr = fmt.Sprintf("user %q is used by the plugin and cannot be managed by a static role", username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error checking user %q: %w", username, err)
+	}
+
+	if respErr != "" {
+		return logical.ErrorResponse(respErr), nil
+	}
+
+	// Take over the user by replacing its tokens with one only Vault knows
+	if err := b.rotateStaticRole(ctx, req.Storage, roleEntry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *thingsDBBackend) pathStaticRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	// Never let a running rotation store the role again
+	b.staticLock.Lock()
+	defer b.staticLock.Unlock()
+
+	err := req.Storage.Delete(ctx, "static-role/"+d.Get("name").(string))
+	if err != nil {
+		return nil, fmt.Errorf("error deleting static role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *thingsDBBackend) pathStaticRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, "static-role/")
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+// currentUser returns the name of the user the plugin is connected as.
+func currentUser(c *thingsDBClient) (string, error) {
+	resp, err := c.Query("@thingsdb", "user_info().load().name;", nil)
+	if err != nil {
+		return "", err
+	}
+
+	name, ok := resp.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected user_info response: %v", resp)
+	}
+
+	return name, nil
+}
+
+const (
+	pathStaticRoleHelpSynopsis    = `Manages the static roles bound to existing ThingsDB users.`
+	pathStaticRoleHelpDescription = `
+This path allows you to read and write static roles. A static role
+binds to an existing ThingsDB user. When the role is created, Vault
+issues a new token for the user and deletes all other tokens of the
+user, so from then on the tokens of the user are owned by Vault.
+With a rotation_period, Vault rotates the token periodically.
+`
+
+	pathStaticRoleListHelpSynopsis    = `List the existing static roles.`
+	pathStaticRoleListHelpDescription = `Static roles will be listed by the role name.`
+)
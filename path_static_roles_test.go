@@ -0,0 +1,156 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	staticRoleName = "teststatic"
+	staticUser     = "service"
+)
+
+// newFakeStaticConn returns a fake connection for a ThingsDB
+// where the plugin is connected as admin and the service user exists.
+func newFakeStaticConn() *fakeConn {
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		switch {
+		case strings.HasPrefix(code, "new_token("):
+			return "statictoken", nil
+		case strings.HasPrefix(code, "has_user("):
+			return vars["user"] == staticUser || vars["user"] == "admin", nil
+		case strings.HasPrefix(code, "user_info()"):
+			return "admin", nil
+		}
+		return nil, nil
+	}
+	return conn
+}
+
+// TestStaticRole checks that static roles take over
+// existing users and return their current token.
+func TestStaticRole(t *testing.T) {
+	b, s := getTestBackend(t)
+	conn := newFakeStaticConn()
+	useFakeConns(b, conn)
+
+	t.Run("Create static role", func(t *testing.T) {
+		resp, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+			"username": staticUser,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Contains(t, conn.Queries(), deleteStaticTokensQuery)
+	})
+
+	t.Run("Username of another static role", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "static-role/other",
+			Data:      map[string]interface{}{"username": staticUser},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		role, err := getStaticRole(context.Background(), s, "other")
+		require.NoError(t, err)
+		require.Nil(t, role)
+	})
+
+	t.Run("Read static role", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-role/" + staticRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, staticUser, resp.Data["username"])
+		require.NotEmpty(t, resp.Data["last_vault_rotation"])
+		require.NotContains(t, resp.Data, "token")
+	})
+
+	t.Run("Read static credentials", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-creds/" + staticRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp.Secret)
+		require.Equal(t, "statictoken", resp.Data["token"])
+		require.Equal(t, staticUser, resp.Data["user"])
+	})
+
+	t.Run("Change username", func(t *testing.T) {
+		resp, err := testStaticRoleWrite(t, b, s, logical.UpdateOperation, map[string]interface{}{
+			"username": "other",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("List static roles", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "static-role/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{staticRoleName}, resp.Data["keys"])
+	})
+
+	t.Run("Delete static role", func(t *testing.T) {
+		queries := len(conn.Queries())
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "static-role/" + staticRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Len(t, conn.Queries(), queries)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-creds/" + staticRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	for name, username := range map[string]string{
+		"Missing username": "",
+		"Unknown user":     "missing",
+		"Plugin user":      "admin",
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := testStaticRoleWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+				"username": username,
+			})
+			require.NoError(t, err)
+			require.True(t, resp.IsError())
+
+			role, err := getStaticRole(context.Background(), s, staticRoleName)
+			require.NoError(t, err)
+			require.Nil(t, role)
+		})
+	}
+}
+
+// Utility function to write a static role and return any errors
+func testStaticRoleWrite(t *testing.T, b *thingsDBBackend, s logical.Storage, op logical.Operation, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      "static-role/" + staticRoleName,
+		Data:      d,
+		Storage:   s,
+	})
+}
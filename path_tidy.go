@@ -0,0 +1,475 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	autoTidyStoragePath = "config/auto-tidy"
+
+	// defaultTidySafetyBuffer is how old a user must be before tidy
+	// considers it, so users being created are never deleted.
+	defaultTidySafetyBuffer = 24 * time.Hour
+
+	// defaultTidyInterval is how often the auto-tidy runs.
+	defaultTidyInterval = 24 * time.Hour
+
+	// defaultTidyUsernamePattern matches the names generated by the
+	// default username template. The names are the same for every mount,
+	// so it is only used to report orphans, never to delete them.
+	defaultTidyUsernamePattern = `^v_.*_[0-9A-Za-z]{20}_[0-9]+$`
+)
+
+// listUsersQuery returns the name and creation time of all users.
+const listUsersQuery = `
+users_info().map(|info| {
+    user = info.load();
+    [user.name, user.get('created_on')];
+});
+`
+
+// thingsDBAutoTidyConfig defines if and how the
+// backend tidies up orphaned users periodically.
+type thingsDBAutoTidyConfig struct {
+	Enabled         bool          `json:"enabled"`
+	Interval        time.Duration `json:"interval"`
+	SafetyBuffer    time.Duration `json:"safety_buffer"`
+	UsernamePattern string        `json:"username_pattern"`
+	LastTidy        time.Time     `json:"last_tidy"`
+}
+
+// thingsDBUser is a user as listed by ThingsDB.
+type thingsDBUser struct {
+	Name      string
+	CreatedOn time.Time
+}
+
+// tidyFields are the fields shared by tidy and the auto-tidy config.
+func tidyFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"safety_buffer": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Users created more recently than this are never tidied. Defaults to 24h",
+			Default:     int(defaultTidySafetyBuffer.Seconds()),
+		},
+		"username_pattern": {
+			Type:        framework.TypeString,
+			Description: "Regular expression matching the names of the users created by this mount. Required to delete users, as other mounts using the same ThingsDB generate the same names with the default username template. A dry run defaults to the names of the default username template",
+		},
+	}
+}
+
+// pathTidy extends the Vault API with a `/tidy` endpoint and
+// a `/config/auto-tidy` endpoint to run it periodically.
+func pathTidy(b *thingsDBBackend) []*framework.Path {
+	tidy := tidyFields()
+	tidy["dry_run"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "Only report the orphaned users, without deleting them",
+		Default:     false,
+	}
+
+	autoTidy := tidyFields()
+	autoTidy["enabled"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: "Delete orphaned users periodically",
+		Default:     false,
+	}
+	autoTidy["interval"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Interval between two runs of the auto-tidy. Defaults to 24h",
+		Default:     int(defaultTidyInterval.Seconds()),
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: "tidy",
+			Fields:  tidy,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathTidyUpdate,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+			},
+			HelpSynopsis:    pathTidyHelpSynopsis,
+			HelpDescription: pathTidyHelpDescription,
+		},
+		{
+			Pattern: "config/auto-tidy",
+			Fields:  autoTidy,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathAutoTidyRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathAutoTidyWrite,
+				},
+			},
+			HelpSynopsis:    pathAutoTidyHelpSynopsis,
+			HelpDescription: pathAutoTidyHelpDescription,
+		},
+	}
+}
+
+func (b *thingsDBBackend) pathTidyUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	safetyBuffer := time.Duration(d.Get("safety_buffer").(int)) * time.Second
+	if safetyBuffer < 0 {
+		return logical.ErrorResponse("safety_buffer cannot be negative"), nil
+	}
+
+	dryRun := d.Get("dry_run").(bool)
+
+	// Users of other mounts are not tracked by this mount, so never
+	// delete users by the names every mount generates by default
+	usernamePattern := d.Get("username_pattern").(string)
+	if usernamePattern == "" {
+		if !dryRun {
+			return logical.ErrorResponse("username_pattern is required unless dry_run is set, matching only the users of this mount"), nil
+		}
+		usernamePattern = defaultTidyUsernamePattern
+	}
+
+	pattern, err := regexp.Compile(usernamePattern)
+	if err != nil {
+		return logical.ErrorResponse("invalid username_pattern: %s", err), nil
+	}
+
+	orphans, err := b.tidyUsers(ctx, req.Storage, pattern, safetyBuffer, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"orphans": orphans,
+			"dry_run": dryRun,
+		},
+	}, nil
+}
+
+func getAutoTidyConfig(ctx context.Context, s logical.Storage) (*thingsDBAutoTidyConfig, error) {
+	entry, err := s.Get(ctx, autoTidyStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &thingsDBAutoTidyConfig{
+		Interval:     defaultTidyInterval,
+		SafetyBuffer: defaultTidySafetyBuffer,
+	}
+
+	if entry == nil {
+		return config, nil
+	}
+
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, fmt.Errorf("error reading auto-tidy configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+func setAutoTidyConfig(ctx context.Context, s logical.Storage, config *thingsDBAutoTidyConfig) error {
+	entry, err := logical.StorageEntryJSON(autoTidyStoragePath, config)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func (b *thingsDBBackend) pathAutoTidyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	lastTidy := ""
+	if !config.LastTidy.IsZero() {
+		lastTidy = config.LastTidy.Format(time.RFC3339)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"enabled":          config.Enabled,
+			"interval":         config.Interval.Seconds(),
+			"safety_buffer":    config.SafetyBuffer.Seconds(),
+			"username_pattern": config.UsernamePattern,
+			"last_tidy":        lastTidy,
+		},
+	}, nil
+}
+
+func (b *thingsDBBackend) pathAutoTidyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled, ok := d.GetOk("enabled"); ok {
+		config.Enabled = enabled.(bool)
+	}
+
+	if interval, ok := d.GetOk("interval"); ok {
+		config.Interval = time.Duration(interval.(int)) * time.Second
+	}
+
+	if safetyBuffer, ok := d.GetOk("safety_buffer"); ok {
+		config.SafetyBuffer = time.Duration(safetyBuffer.(int)) * time.Second
+	}
+
+	if pattern, ok := d.GetOk("username_pattern"); ok {
+		config.UsernamePattern = pattern.(string)
+	}
+
+	if config.Interval <= 0 {
+		return logical.ErrorResponse("interval must be positive"), nil
+	}
+
+	if config.SafetyBuffer < 0 {
+		return logical.ErrorResponse("safety_buffer cannot be negative"), nil
+	}
+
+	if config.Enabled && config.UsernamePattern == "" {
+		return logical.ErrorResponse("username_pattern is required to enable the auto-tidy, matching only the users of this mount"), nil
+	}
+
+	if _, err := regexp.Compile(config.UsernamePattern); err != nil {
+		return logical.ErrorResponse("invalid username_pattern: %s", err), nil
+	}
+
+	if err := setAutoTidyConfig(ctx, req.Storage, config); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// autoTidyIfDue tidies up orphaned users when the auto-tidy
+// is enabled and its interval has passed.
+func (b *thingsDBBackend) autoTidyIfDue(ctx context.Context, s logical.Storage) error {
+	config, err := getAutoTidyConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if !config.Enabled || time.Since(config.LastTidy) < config.Interval {
+		return nil
+	}
+
+	if config.UsernamePattern == "" {
+		return errors.New("auto-tidy is enabled without a username pattern")
+	}
+
+	pattern, err := regexp.Compile(config.UsernamePattern)
+	if err != nil {
+		return fmt.Errorf("invalid username pattern: %w", err)
+	}
+
+	orphans, err := b.tidyUsers(ctx, s, pattern, config.SafetyBuffer, false)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Info("tidied up orphaned users", "deleted", len(orphans))
+
+	config.LastTidy = time.Now()
+	return setAutoTidyConfig(ctx, s, config)
+}
+
+// tidyUsers finds the users in ThingsDB which match the pattern, but are
+// not tracked by the plugin, and deletes them unless it is a dry run.
+// Users created within the safety buffer are left alone.
+func (b *thingsDBBackend) tidyUsers(ctx context.Context, s logical.Storage, pattern *regexp.Regexp, safetyBuffer time.Duration, dryRun bool) ([]string, error) {
+	skip, err := managedUsers(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	err = b.withClient(ctx, s, func(client *thingsDBClient) error {
+		orphans = []string{}
+
+		current, err := currentUser(client)
+		if err != nil {
+			return err
+		}
+
+		users, err := listUsers(client)
+		if err != nil {
+			return err
+		}
+
+		cutoff := time.Now().Add(-safetyBuffer)
+		for _, user := range users {
+			if user.Name == current || skip[user.Name] || !pattern.MatchString(user.Name) {
+				continue
+			}
+
+			// Users of which the age is unknown are never deleted
+			if user.CreatedOn.IsZero() || user.CreatedOn.After(cutoff) {
+				continue
+			}
+
+			index, err := getCredsIndex(ctx, s, user.Name)
+			if err != nil {
+				return err
+			}
+
+			if index == nil {
+				orphans = append(orphans, user.Name)
+			}
+		}
+
+		if dryRun {
+			return nil
+		}
+
+		for _, user := range orphans {
+			b.Logger().Info("deleting orphaned user", "user", user)
+			if err := deleteToken(client, user); err != nil {
+				return fmt.Errorf("error deleting user %q: %w", user, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error tidying users: %w", err)
+	}
+
+	return orphans, nil
+}
+
+// managedUsers returns the users of static roles and the users which
+// are being created, which must never be taken for orphans.
+func managedUsers(ctx context.Context, s logical.Storage) (map[string]bool, error) {
+	users := map[string]bool{}
+
+	names, err := s.List(ctx, "static-role/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		role, err := getStaticRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil {
+			users[role.Username] = true
+		}
+	}
+
+	walIDs, err := framework.ListWAL(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, walID := range walIDs {
+		wal, err := framework.GetWAL(ctx, s, walID)
+		if err != nil {
+			return nil, err
+		}
+
+		if wal == nil || wal.Kind != walTypeUser {
+			continue
+		}
+
+		if data, ok := wal.Data.(map[string]interface{}); ok {
+			if user, ok := data["user"].(string); ok {
+				users[user] = true
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// listUsers returns all users in ThingsDB.
+func listUsers(c *thingsDBClient) ([]thingsDBUser, error) {
+	resp, err := c.Query("@thingsdb", listUsersQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := resp.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected users_info response: %v", resp)
+	}
+
+	users := make([]thingsDBUser, 0, len(list))
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected users_info response: %v", item)
+		}
+
+		name, ok := fields[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected users_info response: %v", item)
+		}
+
+		user := thingsDBUser{Name: name}
+		if createdOn, ok := unixTime(fields[1]); ok {
+			user.CreatedOn = createdOn
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// unixTime converts a number of seconds since the epoch as
+// decoded from a ThingsDB response into a time.
+func unixTime(v interface{}) (time.Time, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return time.Unix(rv.Int(), 0), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return time.Unix(int64(rv.Uint()), 0), true
+	case reflect.Float32, reflect.Float64:
+		return time.Unix(int64(rv.Float()), 0), true
+	}
+	return time.Time{}, false
+}
+
+const pathTidyHelpSynopsis = `
+Delete users in ThingsDB which are no longer tracked by the plugin
+`
+
+const pathTidyHelpDescription = `
+This path lists the ThingsDB users of which the name matches the
+username pattern, and deletes the users which are not tracked by
+the plugin, for example because revoking their lease failed.
+Users of static roles, the user of the plugin and users created
+within the safety buffer are never deleted. With dry_run, the
+orphaned users are only reported.
+
+Users of other mounts using the same ThingsDB are not tracked by
+this mount, while the default username template generates the same
+names for every mount. Deleting users therefore requires a username
+pattern matching only the users of this mount; a dry run defaults
+to the names of the default username template.
+`
+
+const pathAutoTidyHelpSynopsis = `
+Configure the periodic tidy of orphaned ThingsDB users
+`
+
+const pathAutoTidyHelpDescription = `
+This path configures the backend to tidy up orphaned users
+periodically, with the same options as the tidy endpoint. The
+auto-tidy can only be enabled with a username pattern matching
+only the users of this mount.
+`
@@ -0,0 +1,228 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	orphanUser  = "v_token_testthin_aaaaaaaaaaaaaaaaaaaa_1700000000"
+	recentUser  = "v_token_testthin_bbbbbbbbbbbbbbbbbbbb_1700000000"
+	unknownUser = "v_token_testthin_cccccccccccccccccccc_1700000000"
+	staticOld   = "v_token_testthin_dddddddddddddddddddd_1700000000"
+)
+
+// newFakeTidyServer returns a fake connection with a set of users in
+// ThingsDB, of which only the orphaned user should be tidied.
+func newFakeTidyServer() (map[string]interface{}, *fakeConn) {
+	var mu sync.Mutex
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	users := map[string]interface{}{
+		"admin":     int64(1600000000),
+		"service":   uint32(1600000000),
+		orphanUser:  old,
+		recentUser:  time.Now().Unix(),
+		unknownUser: nil,
+		staticOld:   old,
+	}
+
+	conn := newFakeConn()
+	conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		user, _ := vars["user"].(string)
+		switch {
+		case code == listUsersQuery:
+			var list []interface{}
+			for name, createdOn := range users {
+				list = append(list, []interface{}{name, createdOn})
+			}
+			return list, nil
+		case code == createTokenQuery:
+			users[user] = old
+			return "faketoken", nil
+		case strings.HasPrefix(code, "user_info()"):
+			return "admin", nil
+		case strings.HasPrefix(code, "has_user("):
+			_, ok := users[user]
+			return ok, nil
+		case strings.HasPrefix(code, "new_token("):
+			return "statictoken", nil
+		case strings.HasPrefix(code, "del_user("):
+			delete(users, user)
+		}
+		return nil, nil
+	}
+	return users, conn
+}
+
+// TestTidy checks that only users which are not tracked
+// by the plugin are reported and deleted.
+func TestTidy(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	users, conn := newFakeTidyServer()
+	useFakeConns(b, conn)
+
+	_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"target": target,
+		"mask":   mask,
+	})
+	require.NoError(t, err)
+
+	creds, err := b.HandleRequest(ctx, &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "creds/" + roleName,
+		Storage:     s,
+		DisplayName: "token",
+	})
+	require.NoError(t, err)
+	tracked := creds.Data["user"].(string)
+
+	index, err := getCredsIndex(ctx, s, tracked)
+	require.NoError(t, err)
+	require.Equal(t, roleName, index.Role)
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "static-role/" + staticRoleName,
+		Data:      map[string]interface{}{"username": staticOld},
+		Storage:   s,
+	})
+	require.NoError(t, err)
+
+	t.Run("Dry run", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, map[string]interface{}{"dry_run": true})
+		require.NoError(t, err)
+		require.Equal(t, []string{orphanUser}, resp.Data["orphans"])
+		require.Contains(t, users, orphanUser)
+	})
+
+	t.Run("Safety buffer", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, map[string]interface{}{
+			"dry_run":       true,
+			"safety_buffer": "72h",
+		})
+		require.NoError(t, err)
+		require.Empty(t, resp.Data["orphans"])
+	})
+
+	t.Run("Username pattern", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, map[string]interface{}{
+			"dry_run":          true,
+			"username_pattern": "^serv",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"service"}, resp.Data["orphans"])
+
+		resp, err = testTidy(t, b, s, map[string]interface{}{
+			"username_pattern": "(",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Delete without pattern", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, users, orphanUser)
+	})
+
+	t.Run("Delete orphans", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, map[string]interface{}{
+			"username_pattern": "^v_token_testthin_",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{orphanUser}, resp.Data["orphans"])
+		require.NotContains(t, users, orphanUser)
+		require.Contains(t, users, tracked)
+		require.Contains(t, users, recentUser)
+		require.Contains(t, users, unknownUser)
+		require.Contains(t, users, staticOld)
+		require.Contains(t, users, "admin")
+	})
+
+	t.Run("Revoke untracks user", func(t *testing.T) {
+		_, err := b.tokenRevoke(ctx, &logical.Request{
+			Storage: s,
+			Secret:  creds.Secret,
+		}, nil)
+		require.NoError(t, err)
+
+		index, err := getCredsIndex(ctx, s, tracked)
+		require.NoError(t, err)
+		require.Nil(t, index)
+	})
+}
+
+// TestAutoTidy checks that orphaned users are
+// deleted periodically when enabled.
+func TestAutoTidy(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	users, conn := newFakeTidyServer()
+	useFakeConns(b, conn)
+
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.Contains(t, users, orphanUser)
+
+	// Enabling requires a pattern matching only the users of this mount
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/auto-tidy",
+		Data:      map[string]interface{}{"enabled": true, "interval": "1h"},
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/auto-tidy",
+		Data: map[string]interface{}{
+			"enabled":          true,
+			"interval":         "1h",
+			"username_pattern": "^v_token_testthin_",
+		},
+		Storage: s,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.NotContains(t, users, orphanUser)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/auto-tidy",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["enabled"])
+	require.Equal(t, float64(3600), resp.Data["interval"])
+	require.Equal(t, "^v_token_testthin_", resp.Data["username_pattern"])
+	require.NotEmpty(t, resp.Data["last_tidy"])
+
+	// The interval has not passed yet
+	queries := len(conn.Queries())
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.Len(t, conn.Queries(), queries)
+}
+
+// Utility function to tidy users and return any errors
+func testTidy(t *testing.T, b *thingsDBBackend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Data:      d,
+		Storage:   s,
+	})
+}
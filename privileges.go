@@ -0,0 +1,107 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThingsDB privileges which can be granted on a scope.
+const (
+	privilegeQuery = 1 << iota
+	privilegeEvent
+	privilegeGrant
+	privilegeJoin
+	privilegeRun
+
+	privilegeChange = privilegeQuery | privilegeEvent
+	privilegeFull   = privilegeQuery | privilegeEvent | privilegeGrant | privilegeJoin | privilegeRun
+)
+
+// privilegeNames maps the symbolic privilege names to their mask.
+var privilegeNames = map[string]int{
+	"QUERY":  privilegeQuery,
+	"EVENT":  privilegeEvent,
+	"CHANGE": privilegeChange,
+	"GRANT":  privilegeGrant,
+	"JOIN":   privilegeJoin,
+	"RUN":    privilegeRun,
+	"FULL":   privilegeFull,
+}
+
+// parseMask parses a privilege mask given as a number, as symbolic
+// names separated by "|" or ",", or as a list of either.
+func parseMask(values []string) (int, error) {
+	mask := 0
+	found := false
+	for _, value := range values {
+		for _, part := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == '|' || r == ','
+		}) {
+			part = strings.ToUpper(strings.TrimSpace(part))
+			if part == "" {
+				continue
+			}
+
+			if privilege, ok := privilegeNames[part]; ok {
+				mask |= privilege
+			} else if privilege, err := strconv.Atoi(part); err == nil && privilege >= 0 && privilege <= privilegeFull {
+				mask |= privilege
+			} else {
+				return 0, fmt.Errorf("invalid privilege %q, expected a number between 1 and %d or one of QUERY, EVENT, CHANGE, GRANT, JOIN, RUN and FULL", part, privilegeFull)
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, fmt.Errorf("mask cannot be empty")
+	}
+
+	if mask == 0 {
+		return 0, fmt.Errorf("mask must grant at least one privilege")
+	}
+
+	return mask, nil
+}
+
+// maskNames returns the symbolic form of a privilege mask.
+func maskNames(mask int) string {
+	if mask&privilegeFull == privilegeFull {
+		return "FULL"
+	}
+
+	var names []string
+	if mask&privilegeChange == privilegeChange {
+		names = append(names, "CHANGE")
+	} else if mask&privilegeQuery != 0 {
+		names = append(names, "QUERY")
+	} else if mask&privilegeEvent != 0 {
+		names = append(names, "EVENT")
+	}
+
+	for _, privilege := range []struct {
+		name string
+		mask int
+	}{
+		{"GRANT", privilegeGrant},
+		{"JOIN", privilegeJoin},
+		{"RUN", privilegeRun},
+	} {
+		if mask&privilege.mask != 0 {
+			names = append(names, privilege.name)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+// symbolicMask returns the symbolic form of a stored numeric
+// mask, or an empty string if it is not a valid mask.
+func symbolicMask(mask string) string {
+	maskInt, err := strconv.Atoi(mask)
+	if err != nil || maskInt <= 0 {
+		return ""
+	}
+	return maskNames(maskInt)
+}
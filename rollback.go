@@ -0,0 +1,110 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// walTypeUser is the WAL kind written before a user is created
+	walTypeUser = "user"
+
+	// walRollbackMinAge is the minimum age of a WAL entry before it
+	// is rolled back, giving credential creation time to finish.
+	walRollbackMinAge = 10 * time.Minute
+
+	// walRollbackMinAgeOption is the mount option which overrides
+	// the minimum age of a WAL entry before it is rolled back.
+	walRollbackMinAgeOption = "wal_rollback_min_age"
+)
+
+// configureWALRollback sets the minimum age of a WAL entry before it is
+// rolled back from the options of the mount. It is only read when the
+// backend is set up, so the age never changes while rollbacks run.
+func (b *thingsDBBackend) configureWALRollback(options map[string]string) error {
+	raw, ok := options[walRollbackMinAgeOption]
+	if !ok || raw == "" {
+		return nil
+	}
+
+	age, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", walRollbackMinAgeOption, err)
+	}
+
+	if age <= 0 {
+		return fmt.Errorf("%s must be positive", walRollbackMinAgeOption)
+	}
+
+	b.WALRollbackMinAge = age
+	return nil
+}
+
+// walUser is the WAL entry for a ThingsDB user that is
+// about to be created.
+type walUser struct {
+	User           string `json:"user"`
+	TokenID        string `json:"token_id"`
+	RevocationMode string `json:"revocation_mode"`
+}
+
+// walRollback deletes users from ThingsDB of which the creation
+// was not completed, for which the WAL entry still exists.
+func (b *thingsDBBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walTypeUser:
+		return b.rollbackUser(ctx, req.Storage, data)
+	default:
+		return fmt.Errorf("unknown WAL entry kind %q", kind)
+	}
+}
+
+func (b *thingsDBBackend) rollbackUser(ctx context.Context, s logical.Storage, data interface{}) error {
+	entry, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.New("invalid user WAL entry")
+	}
+
+	user, ok := entry["user"].(string)
+	if !ok || user == "" {
+		return errors.New("invalid user WAL entry: missing user")
+	}
+
+	tokenID, _ := entry["token_id"].(string)
+
+	// The user is shared, so only the token is deleted
+	if mode, _ := entry["revocation_mode"].(string); mode == revocationModeDeleteToken {
+		err := b.withClient(ctx, s, func(client *thingsDBClient) error {
+			b.Logger().Info("rolling back partially created token", "user", user, "token_id", tokenID)
+			return deleteUserToken(client, user, "", tokenID)
+		})
+		if err != nil {
+			return err
+		}
+
+		return b.untrackCreds(ctx, s, user, tokenID)
+	}
+
+	err := b.withClient(ctx, s, func(client *thingsDBClient) error {
+		exists, err := userExists(client, user)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return nil
+		}
+
+		b.Logger().Info("rolling back partially created user", "user", user)
+		return deleteToken(client, user)
+	})
+	if err != nil {
+		return err
+	}
+
+	return deleteCredsIndex(ctx, s, user)
+}
@@ -0,0 +1,172 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRollbackUser checks that users which were only partially
+// created are removed from ThingsDB by the WAL rollback.
+func TestRollbackUser(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Rollback failed creation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+
+		created := map[string]bool{}
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			user, _ := vars["user"].(string)
+			switch {
+			case code == createTokenQuery:
+				// The user got created, but the connection broke
+				// before the query could clean up after itself
+				created[user] = true
+				return nil, errors.New("query failed")
+			case strings.HasPrefix(code, "has_user("):
+				return created[user], nil
+			case strings.HasPrefix(code, "del_user("):
+				delete(created, user)
+			}
+			return nil, nil
+		}
+		useFakeConns(b, conn)
+
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask":   mask,
+		})
+		require.NoError(t, err)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.ErrorContains(t, err, "query failed")
+		require.Len(t, created, 1)
+
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 1)
+
+		// Entries younger than the minimum age are left alone
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RollbackOperation,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RollbackOperation,
+			Storage:   s,
+			Data:      map[string]interface{}{"immediate": true},
+		})
+		require.NoError(t, err)
+		require.Empty(t, created)
+
+		walIDs, err = framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	})
+
+	t.Run("No WAL after successful creation", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		useFakeConns(b, newFakeCredsConn())
+
+		_, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"target": target,
+			"mask":   mask,
+		})
+		require.NoError(t, err)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		walIDs, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+	})
+
+	t.Run("Rollback user that was never created", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		conn := newFakeConn()
+		conn.QueryFunc = func(scope string, code string, vars map[string]interface{}) (interface{}, error) {
+			return false, nil
+		}
+		useFakeConns(b, conn)
+
+		err := b.walRollback(ctx, &logical.Request{Storage: s}, walTypeUser, map[string]interface{}{
+			"user": "abcdefgh_1700000000",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"has_user({user});"}, conn.Queries())
+	})
+
+	t.Run("Rollback token of a shared user", func(t *testing.T) {
+		b, s := getTestBackend(t)
+		conn := newFakeConn()
+		useFakeConns(b, conn)
+
+		err := b.walRollback(ctx, &logical.Request{Storage: s}, walTypeUser, map[string]interface{}{
+			"user":            "service",
+			"token_id":        "token_1",
+			"revocation_mode": revocationModeDeleteToken,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{deleteUserTokenQuery}, conn.Queries())
+		require.Equal(t, "token_1", conn.Vars()[0]["token_id"])
+		require.Nil(t, conn.Vars()[0]["token"])
+	})
+}
+
+// TestWALRollbackMinAge checks that the minimum age of a WAL entry
+// before it is rolled back can be set with a mount option.
+func TestWALRollbackMinAge(t *testing.T) {
+	newBackend := func(options map[string]string) (*thingsDBBackend, error) {
+		config := logical.TestBackendConfig()
+		config.StorageView = new(logical.InmemStorage)
+		config.Logger = hclog.NewNullLogger()
+		config.System = logical.TestSystemView()
+		config.Config = options
+
+		b, err := Factory(context.Background(), config)
+		if err != nil {
+			return nil, err
+		}
+		return b.(*thingsDBBackend), nil
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		b, err := newBackend(nil)
+		require.NoError(t, err)
+		require.Equal(t, walRollbackMinAge, b.WALRollbackMinAge)
+	})
+
+	t.Run("Mount option", func(t *testing.T) {
+		b, err := newBackend(map[string]string{"wal_rollback_min_age": "90s"})
+		require.NoError(t, err)
+		require.Equal(t, 90*time.Second, b.WALRollbackMinAge)
+	})
+
+	t.Run("Invalid mount option", func(t *testing.T) {
+		_, err := newBackend(map[string]string{"wal_rollback_min_age": "soon"})
+		require.ErrorContains(t, err, "invalid wal_rollback_min_age")
+
+		_, err = newBackend(map[string]string{"wal_rollback_min_age": "-1m"})
+		require.ErrorContains(t, err, "must be positive")
+	})
+}
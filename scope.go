@@ -0,0 +1,53 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of ThingsDB scopes a grant can target.
+const (
+	scopeThingsDB   = "thingsdb"
+	scopeNode       = "node"
+	scopeCollection = "collection"
+)
+
+// thingsDBScope is a parsed ThingsDB scope.
+type thingsDBScope struct {
+	Kind string
+	// Collection holds the collection name for collection scopes
+	Collection string
+}
+
+// parseScope parses a ThingsDB scope in either the `@` or the
+// `/` notation, like `@thingsdb`, `@node`, `//stuff` or `@:stuff`.
+func parseScope(scope string) (*thingsDBScope, error) {
+	var kind, name string
+	switch {
+	case strings.HasPrefix(scope, "//"):
+		kind, name = "collection", scope[2:]
+	case strings.HasPrefix(scope, "@"):
+		kind, name, _ = strings.Cut(scope[1:], ":")
+	case strings.HasPrefix(scope, "/"):
+		kind, name, _ = strings.Cut(scope[1:], "/")
+	default:
+		return nil, fmt.Errorf("invalid scope %q, expected it to start with @ or /", scope)
+	}
+
+	switch kind {
+	case "thingsdb", "t":
+		if name != "" {
+			return nil, fmt.Errorf("invalid scope %q", scope)
+		}
+		return &thingsDBScope{Kind: scopeThingsDB}, nil
+	case "node", "n":
+		return &thingsDBScope{Kind: scopeNode}, nil
+	case "collection", "c", "":
+		if name == "" {
+			return nil, fmt.Errorf("invalid scope %q, missing collection name", scope)
+		}
+		return &thingsDBScope{Kind: scopeCollection, Collection: name}, nil
+	default:
+		return nil, fmt.Errorf("invalid scope %q", scope)
+	}
+}
@@ -0,0 +1,86 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholders which can be used in the creation and
+// revocation statements of a role.
+const (
+	placeholderName       = "name"
+	placeholderToken      = "token"
+	placeholderTokenID    = "token_id"
+	placeholderExpiration = "expiration"
+	placeholderGrants     = "grants"
+)
+
+var placeholderRegex = regexp.MustCompile(`{{([^{}]*)}}`)
+
+// validateStatements checks that the statements are not empty
+// and only use the given placeholders.
+func validateStatements(statements []string, placeholders ...string) error {
+	for _, statement := range statements {
+		if strings.TrimSpace(statement) == "" {
+			return fmt.Errorf("statements cannot be empty")
+		}
+
+		for _, match := range placeholderRegex.FindAllStringSubmatch(statement, -1) {
+			if !containsString(placeholders, match[1]) {
+				return fmt.Errorf("unsupported placeholder %q in statement %q", match[0], statement)
+			}
+		}
+	}
+	return nil
+}
+
+// usesPlaceholder reports whether any of the statements uses the placeholder.
+func usesPlaceholder(statements []string, placeholder string) bool {
+	for _, statement := range statements {
+		if strings.Contains(statement, "{{"+placeholder+"}}") {
+			return true
+		}
+	}
+	return false
+}
+
+// renderStatements joins the statements into ThingsDB code. The placeholders
+// are replaced with variables, so the values are never part of the code itself.
+func renderStatements(statements []string) string {
+	code := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		statement = strings.TrimSpace(statement)
+		if !strings.HasSuffix(statement, ";") {
+			statement += ";"
+		}
+		code = append(code, placeholderRegex.ReplaceAllString(statement, "$1"))
+	}
+	return strings.Join(code, "\n")
+}
+
+// creationStatementsQuery wraps the creation statements of a role,
+// which must return the new token. When the statements fail, the user
+// is removed again if it did not exist before.
+const creationStatementsQuery = `
+existed = has_user(name);
+token = try({
+%s
+});
+if (is_err(token)) {
+    if (!existed && has_user(name)) {
+        del_user(name);
+    };
+    raise(token);
+};
+token;
+`
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
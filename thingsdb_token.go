@@ -2,16 +2,16 @@ package vault_plugin_secrets_thingsdb
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
-	"math/rand"
-
-	"github.com/google/uuid"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	ti "github.com/thingsdb/go-thingsdb"
 )
 
 const (
@@ -20,9 +20,10 @@ const (
 
 // thingsDBToken defines a secret for the ThingsDb access token
 type thingsDBToken struct {
-	Token   string `json:"token"`
-	User    string `json:"user"`
-	TokenID string `json:"token_id"`
+	Token      string    `json:"token"`
+	User       string    `json:"user"`
+	TokenID    string    `json:"token_id"`
+	Expiration time.Time `json:"expiration"`
 }
 
 // thingsDBToken defines a secret to store for a given role
@@ -39,12 +40,46 @@ func (b *thingsDBBackend) thingsDBToken() *framework.Secret {
 				Type:        framework.TypeString,
 				Description: `The newly created user associated with the token`,
 			},
+			"token_id": {
+				Type:        framework.TypeString,
+				Description: `The description of the token in ThingsDB, identifying it in user_info() without exposing the token`,
+			},
 		},
 		Revoke: b.tokenRevoke,
 		Renew:  b.tokenRenew,
 	}
 }
 
+// deleteUserTokenQuery deletes a single token of the user, by its key
+// for leases of older versions of the plugin, or else by its token ID.
+const deleteUserTokenQuery = `
+user_info(user).load().tokens.filter(|t| t.key == token || t.description == token_id).each(|t| del_token(t.key));
+`
+
+// deleteUserToken deletes the token of a lease, keeping the user.
+func deleteUserToken(c *thingsDBClient, user string, token string, tokenID string) error {
+	vars := map[string]interface{}{
+		"user":     user,
+		"token":    nil,
+		"token_id": nil,
+	}
+
+	// Never match tokens without a key or description
+	if token != "" {
+		vars["token"] = token
+	}
+	if tokenID != "" {
+		vars["token_id"] = tokenID
+	}
+
+	if vars["token"] == nil && vars["token_id"] == nil {
+		return errors.New("secret internal data holds neither a token nor a token ID")
+	}
+
+	_, err := c.Query("@thingsdb", deleteUserTokenQuery, vars)
+	return err
+}
+
 func deleteToken(c *thingsDBClient, user string) error {
 	vars := map[string]interface{}{
 		"user": user,
@@ -54,12 +89,65 @@ func deleteToken(c *thingsDBClient, user string) error {
 	return err
 }
 
-func (b *thingsDBBackend) tokenRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	client, err := b.getClient(ctx, req.Storage)
+// tokenKeyQuery looks up the key of a token of the user by the
+// token ID, which is set as the description of the token.
+const tokenKeyQuery = `
+token = user_info(user).load().tokens.find(|t| t.description == token_id);
+is_nil(token) ? nil : token.key;
+`
+
+// tokenKey returns the key of the token of the user with the
+// token ID, or an empty string if the token no longer exists.
+func tokenKey(c *thingsDBClient, user string, tokenID string) (string, error) {
+	vars := map[string]interface{}{
+		"user":     user,
+		"token_id": tokenID,
+	}
+
+	resp, err := c.Query("@thingsdb", tokenKeyQuery, vars)
 	if err != nil {
-		return nil, fmt.Errorf("error getting client: %w", err)
+		return "", err
+	}
+
+	if resp == nil {
+		return "", nil
+	}
+
+	key, ok := resp.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected user_info response: %v", resp)
+	}
+
+	return key, nil
+}
+
+// revokeToken runs the revocation statements of a role. The token is
+// only known for leases of older versions of the plugin, otherwise it
+// is looked up by the token ID when the statements need it.
+func revokeToken(c *thingsDBClient, user string, token string, tokenID string, expiration time.Time, statements []string) error {
+	if token == "" && tokenID != "" && usesPlaceholder(statements, placeholderToken) {
+		var err error
+		if token, err = tokenKey(c, user, tokenID); err != nil {
+			return err
+		}
+	}
+
+	vars := map[string]interface{}{
+		placeholderName:       user,
+		placeholderToken:      token,
+		placeholderTokenID:    tokenID,
+		placeholderExpiration: nil,
+	}
+
+	if !expiration.IsZero() {
+		vars[placeholderExpiration] = expiration.Unix()
 	}
 
+	_, err := c.Query("@thingsdb", renderStatements(statements), vars)
+	return err
+}
+
+func (b *thingsDBBackend) tokenRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	user := ""
 	userRaw, ok := req.Secret.InternalData["user"]
 	if ok {
@@ -69,80 +157,191 @@ func (b *thingsDBBackend) tokenRevoke(ctx context.Context, req *logical.Request,
 		}
 	}
 
-	if err := deleteToken(client, user); err != nil {
+	// Use the revocation statements and mode of the role when it still
+	// exists, otherwise the user is deleted
+	var statements []string
+	mode := revocationModeDeleteUser
+	if role, ok := req.Secret.InternalData["role"].(string); ok {
+		roleEntry, err := b.getRole(ctx, req.Storage, role)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving role: %w", err)
+		}
+
+		if roleEntry != nil {
+			statements = roleEntry.RevocationStatements
+			mode = roleEntry.revocationMode()
+		}
+	}
+
+	// The mode the lease was issued with takes precedence, so the user
+	// of a role which only deleted the token is never deleted
+	if leaseMode, ok := req.Secret.InternalData["revocation_mode"].(string); ok && leaseMode != "" {
+		mode = leaseMode
+	}
+
+	// Leases of older versions of the plugin still hold the token
+	token, _ := req.Secret.InternalData["token"].(string)
+	tokenID, _ := req.Secret.InternalData["token_id"].(string)
+
+	expiration, err := secretExpiration(req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.withClient(ctx, req.Storage, func(client *thingsDBClient) error {
+		switch {
+		case mode == revocationModeDeleteToken:
+			return deleteUserToken(client, user, token, tokenID)
+		case len(statements) > 0:
+			return revokeToken(client, user, token, tokenID, expiration, statements)
+		default:
+			return deleteToken(client, user)
+		}
+	})
+	if err != nil {
 		return nil, fmt.Errorf("error revoking token: %w", err)
 	}
+
+	// The token is already revoked, so failing here would only make Vault
+	// retry a revocation which ThingsDB rejects for the deleted user. A
+	// stale record keeps the user out of tidy, which is safe.
+	if err := b.untrackCreds(ctx, req.Storage, user, tokenID); err != nil {
+		b.Logger().Warn("error removing user from the credentials index", "user", user, "error", err)
+	}
+
 	return nil, nil
 }
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+// createTokenQuery creates the user, applies the grants in order and
+// creates the token in a single query. The token ID is set as description
+// of the token. When granting or creating the token fails, the user is
+// removed again so nothing is left behind.
+const createTokenQuery = `
+new_user(user);
+token = try({
+    grants.each(|g| grant(g.target, user, g.mask));
+    new_token(user, expiration, token_id);
+});
+if (is_err(token)) {
+    del_user(user);
+    raise(token);
+};
+token;
+`
+
+// createToken provisions a user with a token in ThingsDB. When the role
+// has creation statements, these replace the default provisioning.
+func createToken(c *thingsDBClient, username string, tokenID string, grants []thingsDBGrant, statements []string, expiration time.Time) (*thingsDBToken, error) {
+	grantVars := make([]interface{}, 0, len(grants))
+	for _, grant := range grants {
+		maskInt, err := strconv.Atoi(grant.Mask)
+		if err != nil {
+			return nil, err
+		}
 
-func randomString(n int) string {
-	rand.Seed(time.Now().UnixNano()) // Seed the random number generator
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		grantVars = append(grantVars, map[string]interface{}{
+			"target": grant.Target,
+			"mask":   maskInt,
+		})
 	}
-	return string(b)
-}
 
-func createToken(c *thingsDBClient, target string, mask string) (*thingsDBToken, error) {
-	// Generate random username
-	timestamp := time.Now().Unix()
-	username := fmt.Sprintf("%s_%d", randomString(8), timestamp)
+	var expirationVar interface{}
 
-	maskInt, err := strconv.Atoi(mask)
-	if err != nil {
-		return nil, err
+	// Let ThingsDB expire the token by itself
+	if !expiration.IsZero() {
+		expirationVar = expiration.Unix()
 	}
 
+	code := createTokenQuery
 	vars := map[string]interface{}{
-		"user":   username,
-		"target": target,
-		"mask":   maskInt,
+		"user":       username,
+		"grants":     grantVars,
+		"expiration": expirationVar,
+		"token_id":   tokenID,
 	}
 
-	// Create the user in ThingsDB
-	_, err = c.Query("@thingsdb", "new_user({user});", vars)
-	if err != nil {
-		return nil, err
+	if len(statements) > 0 {
+		code = fmt.Sprintf(creationStatementsQuery, renderStatements(statements))
+		vars = map[string]interface{}{
+			placeholderName:       username,
+			placeholderGrants:     grantVars,
+			placeholderExpiration: expirationVar,
+			placeholderTokenID:    tokenID,
+		}
 	}
 
-	// Grant priviledges to that user
-	_, err = c.Query("@thingsdb", "grant({target}, {user}, {mask});", vars)
+	tokenResp, err := c.Query("@thingsdb", code, vars)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate a token
-	tokenResp, err := c.Query("@thingsdb", "new_token({user});", vars)
-	if err != nil {
-		return nil, err
+	token, ok := tokenResp.(string)
+	if !ok || token == "" {
+		return nil, fmt.Errorf("unexpected new_token response: %v", tokenResp)
 	}
 
-	tokenID := uuid.New().String()
-
 	return &thingsDBToken{
-		User:    username,
-		Token:   tokenResp.(string),
-		TokenID: tokenID,
+		User:       username,
+		Token:      token,
+		TokenID:    tokenID,
+		Expiration: expiration,
 	}, nil
 }
 
+// isUserExistsError reports whether creating a user
+// failed because a user with that name already exists.
+func isUserExistsError(err error) bool {
+	var tiErr *ti.TiError
+	return errors.As(err, &tiErr) && tiErr.Code() == ti.LookupError && strings.Contains(tiErr.Error(), "already exists")
+}
+
 func (b *thingsDBBackend) tokenRenew(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleRaw, ok := req.Secret.InternalData["role"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing role internal data")
 	}
 
-	role := roleRaw.(string)
+	role, ok := roleRaw.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for role in secret internal data")
+	}
+
 	roleEntry, err := b.getRole(ctx, req.Storage, role)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving role: %w", err)
 	}
 
 	if roleEntry == nil {
-		return nil, errors.New("error retrieving role: role is nil")
+		return nil, fmt.Errorf("role %q has been deleted, the lease cannot be renewed", role)
+	}
+
+	expiration, err := secretExpiration(req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !expiration.IsZero() && !time.Now().Before(expiration) {
+		return nil, errors.New("token has expired in ThingsDB, the lease cannot be renewed")
+	}
+
+	user, ok := req.Secret.InternalData["user"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid value for user in secret internal data")
+	}
+
+	// Never extend a lease for a user which is gone in ThingsDB
+	var exists bool
+	err = b.withClient(ctx, req.Storage, func(client *thingsDBClient) error {
+		var err error
+		exists, err = userExists(client, user)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error checking user: %w", err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("user %q no longer exists in ThingsDB, the lease cannot be renewed", user)
 	}
 
 	resp := &logical.Response{Secret: req.Secret}
@@ -154,5 +353,64 @@ func (b *thingsDBBackend) tokenRenew(ctx context.Context, req *logical.Request,
 		resp.Secret.MaxTTL = roleEntry.MaxTTL
 	}
 
+	// ThingsDB cannot extend the expiration of an existing token, so
+	// the lease is capped at the moment ThingsDB expires the token.
+	if !expiration.IsZero() {
+		maxTTL := expiration.Sub(req.Secret.IssueTime)
+		if resp.Secret.MaxTTL <= 0 || resp.Secret.MaxTTL > maxTTL {
+			if roleEntry.MaxTTL > maxTTL {
+				resp.AddWarning(fmt.Sprintf("lease is capped at the token expiration in ThingsDB (%s), request new credentials to use the role's max_ttl", expiration.UTC().Format(time.RFC3339)))
+			}
+			resp.Secret.MaxTTL = maxTTL
+		}
+	}
+
 	return resp, nil
 }
+
+// userExists checks if the user still exists in ThingsDB.
+func userExists(c *thingsDBClient, user string) (bool, error) {
+	vars := map[string]interface{}{
+		"user": user,
+	}
+
+	resp, err := c.Query("@thingsdb", "has_user({user});", vars)
+	if err != nil {
+		return false, err
+	}
+
+	exists, ok := resp.(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected has_user response: %v", resp)
+	}
+
+	return exists, nil
+}
+
+// secretExpiration returns the expiration of the ThingsDB token
+// stored in the secret, or a zero time if it does not expire.
+func secretExpiration(secret *logical.Secret) (time.Time, error) {
+	raw, ok := secret.InternalData["expiration"]
+	if !ok || raw == nil {
+		return time.Time{}, nil
+	}
+
+	var unix int64
+	switch v := raw.(type) {
+	case int64:
+		unix = v
+	case int:
+		unix = int64(v)
+	case float64:
+		unix = int64(v)
+	case json.Number:
+		var err error
+		if unix, err = v.Int64(); err != nil {
+			return time.Time{}, fmt.Errorf("invalid value for expiration in secret internal data: %w", err)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("invalid value for expiration in secret internal data")
+	}
+
+	return time.Unix(unix, 0), nil
+}
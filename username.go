@@ -0,0 +1,116 @@
+package vault_plugin_secrets_thingsdb
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/vault/sdk/helper/template"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// defaultUsernameTemplate names users after the requester and
+	// the role, with a random suffix to keep the names unique.
+	defaultUsernameTemplate = `{{ printf "v_%s_%s_%s_%s" (.DisplayName | sanitize | truncate 8) (.RoleName | truncate 8) (random 20) (unix_time) | truncate 128 }}`
+
+	// maxUsernameLength is the longest user name ThingsDB accepts.
+	maxUsernameLength = 128
+)
+
+// usernameMetadata is the data available to a username template.
+type usernameMetadata struct {
+	RoleName    string
+	DisplayName string
+	EntityID    string
+}
+
+// usernameTemplate returns the template used to name users of the role.
+func (r *thingsDBRoleEntry) usernameTemplate() string {
+	if r.UsernameTemplate == "" {
+		return defaultUsernameTemplate
+	}
+	return r.UsernameTemplate
+}
+
+// sampleUsernameMetadata is used to check that a username template
+// generates valid names when a role is written.
+var sampleUsernameMetadata = usernameMetadata{
+	DisplayName: "token",
+	EntityID:    "00000000-0000-0000-0000-000000000000",
+}
+
+// generateUsername returns the name for a new ThingsDB user
+// of the role, based on the username template of the role.
+func generateUsername(roleEntry *thingsDBRoleEntry, req *logical.Request) (string, error) {
+	return renderUsername(roleEntry.usernameTemplate(), usernameMetadata{
+		RoleName:    roleEntry.Name,
+		DisplayName: req.DisplayName,
+		EntityID:    req.EntityID,
+	})
+}
+
+// renderUsername renders a username template and validates the result.
+func renderUsername(usernameTemplate string, metadata usernameMetadata) (string, error) {
+	tmpl, err := template.NewTemplate(
+		template.Template(usernameTemplate),
+		template.Function("sanitize", sanitizeUsername),
+	)
+	if err != nil {
+		return "", fmt.Errorf("invalid username template: %w", err)
+	}
+
+	username, err := tmpl.Generate(metadata)
+	if err != nil {
+		return "", fmt.Errorf("error generating username: %w", err)
+	}
+
+	if err := validateUsername(username); err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+// sanitizeUsername replaces the characters which are not allowed in the
+// name of a user by an underscore, so display names like the name claim
+// of an OIDC login can be used in a username template.
+func sanitizeUsername(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isInvalidUsernameRune(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// isInvalidUsernameRune reports whether the rune is not allowed in the
+// name of a user. The slash is used as a separator in storage keys.
+func isInvalidUsernameRune(r rune) bool {
+	return r > unicode.MaxASCII || !unicode.IsGraphic(r) || unicode.IsSpace(r) || r == '/'
+}
+
+// validateUsername checks the name against the rules
+// ThingsDB has for the name of a user.
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("username %q is longer than %d characters", username, maxUsernameLength)
+	}
+
+	if strings.IndexFunc(username, func(r rune) bool {
+		return r != '/' && isInvalidUsernameRune(r)
+	}) >= 0 {
+		return fmt.Errorf("username %q may only contain printable ASCII characters without spaces", username)
+	}
+
+	// The name is used as a key in the credentials index
+	if strings.Contains(username, "/") {
+		return fmt.Errorf("username %q cannot contain a slash", username)
+	}
+
+	return nil
+}